@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/monax/compilers/perform"
@@ -23,6 +22,7 @@ var (
 	binlibraries string
 	binarySSL    bool
 	binaryLocal  bool
+	binaryToken  string
 )
 
 var binaryCmd = &cobra.Command{
@@ -30,14 +30,16 @@ var binaryCmd = &cobra.Command{
 	Short: "link a binary to an address",
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
-			fmt.Errorf("Specify a contract to compile \n\n")
+			log.Error("Specify a contract to compile")
 			CompilersCmd.Help()
 			os.Exit(0)
 		}
 		url := createUrl(true)
+		perform.Client = clientConfig(binaryToken, binaryUrl)
 		output, err := perform.RequestBinaryLinkage(url, args[0], libraries)
 		if err != nil {
 			log.Error(err)
+			os.Exit(1)
 		}
 		log.WithFields(log.Fields{
 			"binary": output.Binary,
@@ -48,9 +50,11 @@ var binaryCmd = &cobra.Command{
 
 func addBinaryFlags() {
 	binaryCmd.Flags().StringVarP(&binaryPort, "port", "p", setDefaultPort(), "call listening port")
-	binaryCmd.Flags().StringVarP(&binaryUrl, "url", "u", setDefaultURL(), "set the url for where to compile your contracts (no http(s) or port, please)")
+	binaryCmd.Flags().StringVarP(&binaryUrl, "url", "u", setDefaultURL(), "set the url for where to compile your contracts (no http(s) or port, please), or unix:<path> of the server's socket")
 	binaryCmd.Flags().StringVarP(&binaryDir, "dir", "D", setDefaultDirectoryRoute(true), "directory location to search for on the remote server")
 	binaryCmd.Flags().StringVarP(&binlibraries, "libs", "L", "", "libraries string (libName:Address[, or whitespace]...)")
 	binaryCmd.Flags().BoolVarP(&binarySSL, "ssl", "s", setCompilerSSL(), "call https")
 	binaryCmd.Flags().BoolVarP(&binaryLocal, "local", "l", setCompilerLocal(), "use local compilers to compile message (good for debugging or if server goes down)")
+	binaryCmd.Flags().StringVarP(&binaryToken, "token", "t", setDefaultToken(), "API token for servers which require one (or set $MONAX_COMPILERS_TOKEN)")
+	addClientTLSFlags(binaryCmd)
 }
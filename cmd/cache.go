@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/monax/compilers/perform"
+
+	"github.com/monax/cli/config"
+	"github.com/monax/cli/log"
+
+	"github.com/spf13/cobra"
+)
+
+func BuildCacheCommand() {
+	CompilersCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheExportCmd)
+	cacheCmd.AddCommand(cacheImportCmd)
+	addCacheFlags()
+}
+
+var (
+	cacheHashes   []string
+	cacheManifest string
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "move compiled results between caches",
+	Long: `move compiled results between caches
+
+Cache bundles carry compiled objects together with the compiler version and
+settings they were produced with, so that machines without access to a
+compile server can be served the results from their local cache.`,
+}
+
+var cacheExportCmd = &cobra.Command{
+	Use:   "export FILE.tar.gz",
+	Short: "write cached results to a bundle",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		config.InitMonaxDir()
+		manifest, err := perform.ExportCache(args[0], bundleFilter())
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		log.WithFields(log.Fields{
+			"bundle":  args[0],
+			"entries": len(manifest.Entries),
+		}).Warn("Exported cache")
+	},
+}
+
+var cacheImportCmd = &cobra.Command{
+	Use:   "import FILE.tar.gz",
+	Short: "verify and install the results in a bundle into the cache",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		config.InitMonaxDir()
+		manifest, err := perform.ImportCache(args[0], bundleFilter())
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		for _, entry := range manifest.Entries {
+			log.WithFields(log.Fields{
+				"lang":     entry.Language,
+				"hash":     entry.Hash,
+				"compiler": entry.CompilerVersion,
+				"optimize": entry.Optimize,
+			}).Info("Imported entry")
+		}
+		log.WithFields(log.Fields{
+			"bundle":  args[0],
+			"entries": len(manifest.Entries),
+		}).Warn("Imported cache")
+	},
+}
+
+func addCacheFlags() {
+	cacheCmd.PersistentFlags().StringSliceVarP(&cacheHashes, "hash", "H", []string{}, "only include entries with these source hashes")
+	cacheCmd.PersistentFlags().StringVarP(&cacheManifest, "manifest", "m", "", "only include entries for the source files listed (one per line) in this file")
+}
+
+func bundleFilter() perform.BundleFilter {
+	filter := perform.BundleFilter{Hashes: cacheHashes}
+	if cacheManifest != "" {
+		manifestFilter, err := perform.ManifestFilter(cacheManifest)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		if len(manifestFilter.Hashes) == 0 {
+			log.Errorf("No source files listed in %s", cacheManifest)
+			os.Exit(1)
+		}
+		filter.Hashes = append(filter.Hashes, manifestFilter.Hashes...)
+	}
+	return filter
+}
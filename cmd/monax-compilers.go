@@ -46,6 +46,8 @@ func AddCommands() {
 	BuildServerCommand()
 	BuildCompileCommand()
 	BuildBinaryCommand()
+	BuildCacheCommand()
+	BuildStatusCommand()
 }
 
 func AddGlobalFlags() {
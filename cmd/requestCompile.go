@@ -1,10 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/monax/cli/log"
 	"github.com/monax/compilers/perform"
@@ -26,6 +29,14 @@ var (
 	compilerSSL   bool
 	compilerLocal bool
 	optimizeSolc  bool
+	compileAsync  bool
+	compileToken  string
+
+	// client certificate and CA flags, shared by the commands which call a
+	// server
+	clientCert string
+	clientKey  string
+	clientCA   string
 )
 
 var compileCmd = &cobra.Command{
@@ -33,16 +44,26 @@ var compileCmd = &cobra.Command{
 	Short: "compile your contracts either remotely or locally",
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
-			fmt.Errorf("Specify a contract to compile \n\n")
+			log.Error("Specify a contract to compile")
 			CompilersCmd.Help()
 			os.Exit(0)
 		}
 
 		url := createUrl(false)
+		perform.Client = clientConfig(compileToken, compilerUrl)
 
-		output, err := perform.RequestCompile(url, args[0], optimizeSolc, libraries)
+		// give up on the compile, and cancel it on the server, on Ctrl-C
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		requestCompile := perform.RequestCompileContext
+		if compileAsync {
+			requestCompile = perform.RequestCompileJobContext
+		}
+		output, err := requestCompile(ctx, url, args[0], optimizeSolc, libraries)
 		if err != nil {
 			log.Error(err)
+			os.Exit(1)
 		}
 		perform.PrintResponse(*output, true)
 	},
@@ -50,12 +71,48 @@ var compileCmd = &cobra.Command{
 
 func addCompileFlags() {
 	compileCmd.Flags().StringVarP(&compilerPort, "port", "p", setDefaultPort(), "call listening port")
-	compileCmd.Flags().StringVarP(&compilerUrl, "url", "u", setDefaultURL(), "set the url for where to compile your contracts (no http(s) or port, please)")
+	compileCmd.Flags().StringVarP(&compilerUrl, "url", "u", setDefaultURL(), "set the url for where to compile your contracts (no http(s) or port, please), or unix:<path> of the server's socket")
 	compileCmd.Flags().StringVarP(&compilerDir, "dir", "D", setDefaultDirectoryRoute(false), "directory location to search for on the remote server")
 	compileCmd.Flags().StringVarP(&libraries, "libs", "L", "", "libraries string (libName:Address[, or whitespace]...)")
 	compileCmd.Flags().BoolVarP(&compilerSSL, "ssl", "s", setCompilerSSL(), "call https")
 	compileCmd.Flags().BoolVarP(&compilerLocal, "local", "l", setCompilerLocal(), "use local compilers to compile message (good for debugging or if server goes down)")
 	compileCmd.Flags().BoolVarP(&optimizeSolc, "optimize", "o", setOptimizeSolc(), "optimize code (solidity only)")
+	compileCmd.Flags().BoolVarP(&compileAsync, "async", "a", setCompileAsync(), "compile as a server side job, polling until it finishes (for long compiles)")
+	compileCmd.Flags().StringVarP(&compileToken, "token", "t", setDefaultToken(), "API token for servers which require one (or set $MONAX_COMPILERS_TOKEN)")
+	addClientTLSFlags(compileCmd)
+}
+
+func addClientTLSFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&clientCert, "cert", "c", setDefaultClientCert(), "certificate to present to servers which verify clients")
+	cmd.Flags().StringVarP(&clientKey, "key", "k", setDefaultClientKey(), "key of the client certificate")
+	cmd.Flags().StringVarP(&clientCA, "ca", "", setDefaultClientCA(), "CA certificates to trust the server by instead of the system roots, or the sha256: fingerprint of a CA to pin")
+}
+
+// client settings from the flags of the command being run
+func clientConfig(token, host string) perform.ClientConfig {
+	config := perform.ClientConfig{
+		Token:    clientToken(token),
+		CertFile: clientCert,
+		KeyFile:  clientKey,
+		CAFile:   clientCA,
+	}
+	if strings.HasPrefix(clientCA, perform.FingerprintPrefix) {
+		config.CAFile = ""
+		config.CAFingerprint = clientCA
+	}
+	if strings.HasPrefix(host, perform.UnixPrefix) {
+		config.Socket = host
+	}
+	return config
+}
+
+// host and port of the server in a URL, which are only placeholders when
+// connecting to it over a socket
+func serverHost(host, port string) string {
+	if strings.HasPrefix(host, perform.UnixPrefix) {
+		return "localhost"
+	}
+	return host + ":" + port
 }
 
 func createUrl(binaries bool) string {
@@ -63,15 +120,15 @@ func createUrl(binaries bool) string {
 		return ""
 	} else if binaries {
 		if binarySSL {
-			return "https://" + binaryUrl + ":" + binaryPort + binaryDir
+			return "https://" + serverHost(binaryUrl, binaryPort) + binaryDir
 		} else {
-			return "http://" + binaryUrl + ":" + binaryPort + binaryDir
+			return "http://" + serverHost(binaryUrl, binaryPort) + binaryDir
 		}
 	} else {
 		if compilerSSL {
-			return "https://" + compilerUrl + ":" + compilerPort + compilerDir
+			return "https://" + serverHost(compilerUrl, compilerPort) + compilerDir
 		} else {
-			return "http://" + compilerUrl + ":" + compilerPort + compilerDir
+			return "http://" + serverHost(compilerUrl, compilerPort) + compilerDir
 		}
 	}
 }
@@ -80,6 +137,10 @@ func setOptimizeSolc() bool {
 	return false
 }
 
+func setCompileAsync() bool {
+	return false
+}
+
 func setCompilerLocal() bool {
 	return false
 }
@@ -95,6 +156,31 @@ func setDefaultDirectoryRoute(binaries bool) string {
 	return "/"
 }
 
+func setDefaultClientCert() string {
+	return ""
+}
+
+func setDefaultClientKey() string {
+	return ""
+}
+
+func setDefaultClientCA() string {
+	return ""
+}
+
+func setDefaultToken() string {
+	return ""
+}
+
+// the token given on the command line, or else the one in the environment,
+// which is not made the flag's default so that help does not print it
+func clientToken(flag string) string {
+	if flag != "" {
+		return flag
+	}
+	return os.Getenv("MONAX_COMPILERS_TOKEN")
+}
+
 func setDefaultURL() string {
 	return "compilers.monax.io"
 }
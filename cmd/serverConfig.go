@@ -0,0 +1,331 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/monax/compilers/definitions"
+
+	"github.com/BurntSushi/toml"
+	"github.com/monax/cli/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Server settings may be given on the command line, in the environment or in
+// the file passed to --config, in that order of precedence, falling back on
+// the flags' defaults. Each setting of the file is a server flag, keyed by
+// section, and may be overridden by the environment variable named after the
+// flag, e.g. secure-port by MONAX_COMPILERS_SERVER_SECURE_PORT:
+//
+//	[listen]
+//	secure_port = 9098
+//	[workers]
+//	count = 8
+//	queue_timeout = "1m"
+//
+// Compilers are configured by language, their path and cache directory
+// being overridden by MONAX_COMPILERS_SERVER_<LANGUAGE>_PATH and _CACHE:
+//
+//	[compilers.sol]
+//	path = "/usr/local/bin/solc"
+//	cache = "/var/cache/monax/solc"
+var serverConfigKeys = map[string]string{
+	"listen.port":             "port",
+	"listen.secure_port":      "secure-port",
+	"listen.grpc_port":        "grpc-port",
+	"listen.addresses":        "listen",
+	"listen.socket_mode":      "socket-mode",
+	"listen.no_ssl":           "no-ssl",
+	"listen.secure_only":      "secure-only",
+	"tls.cert":                "cert",
+	"tls.key":                 "key",
+	"tls.client_ca":           "client-ca",
+	"tls.self_signed":         "self-signed",
+	"tls.self_signed_hosts":   "self-signed-hosts",
+	"auth.token_file":         "token-file",
+	"workers.count":           "workers",
+	"workers.queue_size":      "queue-size",
+	"workers.queue_timeout":   "queue-timeout",
+	"workers.job_retention":   "job-retention",
+	"workers.grace_period":    "grace-period",
+	"limits.rate_requests":    "rate-requests",
+	"limits.rate_bytes":       "rate-bytes",
+	"limits.rate_cpu":         "rate-cpu",
+	"limits.quota_requests":   "quota-requests",
+	"limits.quota_bytes":      "quota-bytes",
+	"limits.quota_cpu":        "quota-cpu",
+	"limits.max_request_size": "max-request-size",
+	"cors.origins":            "cors-origins",
+	"cors.methods":            "cors-methods",
+	"cors.headers":            "cors-headers",
+	"cors.max_age":            "cors-max-age",
+	"log.level":               "log-level",
+	"log.format":              "log-format",
+}
+
+// section of the config file holding the settings of each compiler
+const compilersSection = "compilers"
+
+const serverEnvPrefix = "MONAX_COMPILERS_SERVER_"
+
+// Compiler executable and cache directory of a language
+type compilerSettings struct {
+	Path  string
+	Cache string
+}
+
+var serverConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "manage the server's configuration file",
+}
+
+var serverConfigCheckCmd = &cobra.Command{
+	Use:   "check [FILE]",
+	Short: "check a server configuration file, by default the one passed to --config",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 0 {
+			serverConfigFile = args[0]
+		}
+		if serverConfigFile == "" {
+			log.Error("Specify a configuration file to check")
+			os.Exit(1)
+		}
+		if err := loadServerConfig(serverCmd.Flags()); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		if err := checkServerSettings(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", serverConfigFile)
+	},
+}
+
+// the environment variable overriding a server flag
+func serverEnvVar(name string) string {
+	return serverEnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Apply the settings of the environment and the config file, if any, to the
+// server flags not given on the command line, and configure the compilers
+func loadServerConfig(flags *pflag.FlagSet) error {
+	file := make(map[string]interface{})
+	var compilers map[string]compilerSettings
+	if serverConfigFile != "" {
+		meta, err := toml.DecodeFile(serverConfigFile, &file)
+		if err != nil {
+			return fmt.Errorf("Could not read %s: %s", serverConfigFile, err)
+		}
+		if compilers, err = decodeCompilers(file); err != nil {
+			return fmt.Errorf("%s: %s", serverConfigFile, err)
+		}
+		for _, key := range meta.Keys() {
+			if !knownSetting(key) {
+				return fmt.Errorf("%s: unknown setting %s", serverConfigFile, key)
+			}
+		}
+	}
+
+	for key, name := range serverConfigKeys {
+		flag := flags.Lookup(name)
+		if flag.Changed {
+			continue
+		}
+		if value, ok := os.LookupEnv(serverEnvVar(name)); ok {
+			if err := flag.Value.Set(value); err != nil {
+				return fmt.Errorf("%s: %s", serverEnvVar(name), err)
+			}
+			continue
+		}
+		value, ok := lookupSetting(file, key)
+		if !ok {
+			continue
+		}
+		text, err := settingText(value)
+		if err == nil {
+			err = flag.Value.Set(text)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", serverConfigFile, key, err)
+		}
+	}
+
+	for lang := range definitions.Languages {
+		settings := compilers[lang]
+		if path, ok := os.LookupEnv(serverEnvVar(lang + "_path")); ok {
+			settings.Path = path
+		}
+		if cache, ok := os.LookupEnv(serverEnvVar(lang + "_cache")); ok {
+			settings.Cache = cache
+		}
+		configureCompiler(lang, settings)
+	}
+	return nil
+}
+
+// whether key is a section or a setting of the config file, those of the
+// compilers section being checked by decodeCompilers
+func knownSetting(key toml.Key) bool {
+	if key[0] == compilersSection {
+		return true
+	}
+	for known := range serverConfigKeys {
+		if known == key.String() || len(key) == 1 && strings.HasPrefix(known, key[0]+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// the compilers section of a config file, checking it names only known
+// languages
+func decodeCompilers(file map[string]interface{}) (map[string]compilerSettings, error) {
+	compilers := make(map[string]compilerSettings)
+	section, ok := file[compilersSection]
+	if !ok {
+		return compilers, nil
+	}
+	tables, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a table of languages", compilersSection)
+	}
+	for lang, table := range tables {
+		if _, ok := definitions.Languages[lang]; !ok {
+			return nil, fmt.Errorf("unknown language %s in %s, expected one of %s",
+				lang, compilersSection, strings.Join(languageNames(), ", "))
+		}
+		settings := compilerSettings{}
+		fields, ok := table.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s.%s must be a table", compilersSection, lang)
+		}
+		for name, value := range fields {
+			text, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s.%s.%s must be a string", compilersSection, lang, name)
+			}
+			switch name {
+			case "path":
+				settings.Path = text
+			case "cache":
+				settings.Cache = text
+			default:
+				return nil, fmt.Errorf("unknown setting %s.%s.%s", compilersSection, lang, name)
+			}
+		}
+		compilers[lang] = settings
+	}
+	return compilers, nil
+}
+
+func configureCompiler(lang string, settings compilerSettings) {
+	config := definitions.Languages[lang]
+	if settings.Path != "" {
+		cmd := append([]string{settings.Path}, config.CompileCmd[1:]...)
+		config.CompileCmd = cmd
+	}
+	if settings.Cache != "" {
+		config.CacheDir = settings.Cache
+	}
+	definitions.Languages[lang] = config
+}
+
+func languageNames() []string {
+	var names []string
+	for lang := range definitions.Languages {
+		names = append(names, lang)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the value of a section.name key of a decoded config file
+func lookupSetting(file map[string]interface{}, key string) (interface{}, bool) {
+	parts := strings.SplitN(key, ".", 2)
+	section, ok := file[parts[0]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	value, ok := section[parts[1]]
+	return value, ok
+}
+
+// a config file value as it would be given on the command line
+func settingText(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			text, err := settingText(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = text
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// Check server settings which cannot be used together or refer to missing
+// files
+func checkServerSettings() error {
+	if _, err := log.ParseLevel(logLevel); logLevel != "" && err != nil {
+		return fmt.Errorf("unknown log level %q", logLevel)
+	}
+	switch logFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", logFormat)
+	}
+	if _, err := strconv.ParseUint(socketMode, 8, 32); err != nil {
+		return fmt.Errorf("invalid socket mode %q, expected octal permissions such as 0660", socketMode)
+	}
+	if noSSL {
+		if selfSigned {
+			return fmt.Errorf("--self-signed generates a certificate for https, drop the --no-ssl flag to use it")
+		}
+		if serverCA != "" {
+			return fmt.Errorf("Client certificates are only verified over https, drop the --no-ssl flag to use --client-ca")
+		}
+	} else if serverCA != "" && len(listenAddrs) > 0 {
+		return fmt.Errorf("Client certificates are only verified over https, drop the --listen flag to use --client-ca")
+	} else if !selfSigned && securePort != 0 {
+		if _, err := os.Stat(serverKey); os.IsNotExist(err) {
+			return fmt.Errorf("Can't find ssl key %s. Use --no-ssl flag to disable", serverKey)
+		}
+		if _, err := os.Stat(serverCert); os.IsNotExist(err) {
+			return fmt.Errorf("Can't find ssl cert %s. Use --no-ssl flag to disable", serverCert)
+		}
+	}
+	for _, file := range []string{tokenFile, serverCA} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set the log level and format of the server, the level only when given so
+// that --verbose and --debug still apply otherwise
+func configureServerLog() {
+	if level, err := log.ParseLevel(logLevel); logLevel != "" && err == nil {
+		log.SetLevel(level)
+	}
+	if logFormat == "json" {
+		log.SetFormatter(new(log.JSONFormatter))
+	}
+}
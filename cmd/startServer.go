@@ -1,8 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
+	"syscall"
+	"time"
 
 	server "github.com/monax/compilers/perform"
 
@@ -13,59 +19,160 @@ import (
 
 func BuildServerCommand() {
 	CompilersCmd.AddCommand(serverCmd)
+	serverCmd.AddCommand(serverConfigCmd)
+	serverConfigCmd.AddCommand(serverConfigCheckCmd)
 	addServerFlags()
 }
 
 var (
-	serverPort uint64
-	securePort uint64
-	noSSL      bool
-	secureOnly bool
-	serverCert string
-	serverKey  string
+	serverPort   uint64
+	securePort   uint64
+	grpcPort     uint64
+	noSSL        bool
+	secureOnly   bool
+	serverCert   string
+	serverKey    string
+	gracePeriod  time.Duration
+	workers      int
+	queueSize    int
+	queueTimeout time.Duration
+	jobRetention time.Duration
+	tokenFile    string
+	serverCA     string
+	limits       server.LimitConfig
+	maxRequest   int64
+	cors         server.CORSConfig
+	selfSigned   bool
+	certHosts    []string
+	logLevel     string
+	logFormat    string
+	listenAddrs  []string
+	socketMode   string
+
+	serverConfigFile string
 )
 
 var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "start a compiler server",
 	Run: func(cmd *cobra.Command, args []string) {
+		if err := loadServerConfig(cmd.Flags()); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		configureServerLog()
+		if err := checkServerSettings(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
 		addrUnsecure := ""
 		addrSecure := ""
+		if serverPort != 0 {
+			addrUnsecure = ":" + strconv.FormatUint(serverPort, 10)
+		}
+		if securePort != 0 {
+			addrSecure = ":" + strconv.FormatUint(securePort, 10)
+		}
+		mode, _ := strconv.ParseUint(socketMode, 8, 32)
+		addrGRPC := ""
+		if grpcPort != 0 {
+			addrGRPC = ":" + strconv.FormatUint(grpcPort, 10)
+		}
 
-		addrUnsecure += ":" + strconv.FormatUint(serverPort, 10)
-		addrSecure += ":" + strconv.FormatUint(securePort, 10)
+		if selfSigned {
+			files, err := server.SelfSigned(server.SelfSignedPath, certHosts)
+			if err != nil {
+				log.Errorf("Could not generate a self-signed certificate: %s", err)
+				os.Exit(1)
+			}
+			serverCert, serverKey = files.CertFile, files.KeyFile
+			log.WithFields(log.Fields{
+				"ca":          files.CAFile,
+				"fingerprint": files.Fingerprint,
+			}).Warn("Using a self-signed certificate")
+			fmt.Printf("Clients can trust this server with --ca %s\n", files.Fingerprint)
+		}
 
 		if noSSL {
 			addrSecure = ""
-		} else {
-			if secureOnly {
-				addrUnsecure = ""
-			}
-			if _, err := os.Stat(serverKey); os.IsNotExist(err) {
-				log.Error("Can't find ssl key %s. Use --no-ssl flag to disable", serverKey)
-				os.Exit(1)
-			}
-			if _, err := os.Stat(serverCert); os.IsNotExist(err) {
-				log.Error("Can't find ssl cert %s. Use --no-ssl flag to disable", serverCert)
-				os.Exit(1)
-			}
+		} else if secureOnly || serverCA != "" {
+			// client certificates can only be required over https
+			addrUnsecure = ""
 		}
 
-		_, ch := server.StartServer(addrUnsecure, addrSecure, serverCert, serverKey)
-		if err := <-ch; err != nil {
+		// shut down gracefully on SIGINT or SIGTERM
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		srv, err := server.StartServer(ctx, server.ServerConfig{
+			AddrInsecure:    addrUnsecure,
+			AddrSecure:      addrSecure,
+			AddrGRPC:        addrGRPC,
+			Listen:          listenAddrs,
+			SocketMode:      os.FileMode(mode),
+			CertFile:        serverCert,
+			KeyFile:         serverKey,
+			GracePeriod:     gracePeriod,
+			Workers:         workers,
+			QueueSize:       queueSize,
+			QueueTimeout:    queueTimeout,
+			JobRetention:    jobRetention,
+			TokenFile:       tokenFile,
+			ClientCAFile:    serverCA,
+			Limits:          limits,
+			MaxRequestBytes: maxRequest,
+			CORS:            cors,
+		})
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		if err := srv.Wait(); err != nil {
 			log.Errorf("Compile server stopped: %s", err)
 			os.Exit(1)
 		}
+		log.Warn("Compile server stopped")
 	},
 }
 
 func addServerFlags() {
-	serverCmd.Flags().Uint64VarP(&serverPort, "port", "p", setServerPort(), "set the listening port for http")
-	serverCmd.Flags().Uint64VarP(&securePort, "secure-port", "s", setSecurePort(), "set the listening port for https")
+	serverCmd.PersistentFlags().StringVarP(&serverConfigFile, "config", "", setServerConfigFile(), "TOML file of server settings, overridden by the environment and the command line (or set $MONAX_COMPILERS_SERVER_CONFIG)")
+	serverCmd.Flags().Uint64VarP(&serverPort, "port", "p", setServerPort(), "set the listening port for http, 0 to disable")
+	serverCmd.Flags().Uint64VarP(&securePort, "secure-port", "s", setSecurePort(), "set the listening port for https, 0 to disable")
+	serverCmd.Flags().Uint64VarP(&grpcPort, "grpc-port", "", setGRPCPort(), "set the listening port for gRPC, served over TLS unless --no-ssl, 0 to disable")
+	serverCmd.Flags().StringSliceVarP(&listenAddrs, "listen", "", setListen(), "further addresses to serve http on: unix:<path> of a socket, or systemd for the sockets of socket activation")
+	serverCmd.Flags().StringVarP(&socketMode, "socket-mode", "", setSocketMode(), "permissions of the sockets created by --listen, in octal")
 	serverCmd.Flags().BoolVarP(&noSSL, "no-ssl", "n", setSSL(), "use only http")
 	serverCmd.Flags().BoolVarP(&secureOnly, "secure-only", "o", setSecureOnly(), "use only https")
-	serverCmd.Flags().StringVarP(&serverCert, "cert", "c", setDefaultServerCert(), "set the https certificate")
+	serverCmd.Flags().StringVarP(&serverCert, "cert", "c", setDefaultServerCert(), "set the https certificate, re-read when it changes or on SIGHUP")
 	serverCmd.Flags().StringVarP(&serverKey, "key", "k", setDefaultServerKey(), "set the key to interact with the https certificate")
+	serverCmd.Flags().BoolVarP(&selfSigned, "self-signed", "", setSelfSigned(), "serve https with a certificate signed by a generated local CA instead of --cert and --key")
+	serverCmd.Flags().StringSliceVarP(&certHosts, "self-signed-hosts", "", setSelfSignedHosts(), "hostnames and IP addresses the self-signed certificate is for")
+	serverCmd.Flags().DurationVarP(&gracePeriod, "grace-period", "g", setGracePeriod(), "how long to let in-flight requests finish when shutting down")
+	serverCmd.Flags().IntVarP(&workers, "workers", "w", setWorkers(), "number of compilers to run at once")
+	serverCmd.Flags().IntVarP(&queueSize, "queue-size", "q", setQueueSize(), "number of compiles which may wait for a worker before requests are turned away")
+	serverCmd.Flags().DurationVarP(&queueTimeout, "queue-timeout", "t", setQueueTimeout(), "how long a compile may wait for a worker")
+	serverCmd.Flags().DurationVarP(&jobRetention, "job-retention", "r", setJobRetention(), "how long to keep the results of finished compile jobs")
+	serverCmd.Flags().StringVarP(&tokenFile, "token-file", "a", setTokenFile(), "file of API tokens and their scopes to require of clients, re-read on SIGHUP")
+	serverCmd.Flags().StringVarP(&serverCA, "client-ca", "", setClientCA(), "require clients to present a certificate signed by one of these CA certificates, serving https only")
+	serverCmd.Flags().Float64VarP(&limits.RequestsPerMinute, "rate-requests", "", setRateRequests(), "requests each client may make per minute, 0 for no limit")
+	serverCmd.Flags().Float64VarP(&limits.BytesPerMinute, "rate-bytes", "", setRateBytes(), "bytes each client may send to be compiled per minute, 0 for no limit")
+	serverCmd.Flags().DurationVarP(&limits.CPUPerMinute, "rate-cpu", "", setRateCPU(), "compiler CPU time each client may use per minute, 0 for no limit")
+	serverCmd.Flags().Int64VarP(&limits.DailyRequests, "quota-requests", "", setQuotaRequests(), "requests each client may make per day, 0 for no quota")
+	serverCmd.Flags().Int64VarP(&limits.DailyBytes, "quota-bytes", "", setQuotaBytes(), "bytes each client may send to be compiled per day, 0 for no quota")
+	serverCmd.Flags().DurationVarP(&limits.DailyCPU, "quota-cpu", "", setQuotaCPU(), "compiler CPU time each client may use per day, 0 for no quota")
+	serverCmd.Flags().Int64VarP(&maxRequest, "max-request-size", "", setMaxRequestSize(), "largest request body in bytes the server reads")
+	serverCmd.Flags().StringSliceVarP(&cors.AllowedOrigins, "cors-origins", "", setCORSOrigins(), "origins browsers may call the server from, * for any")
+	serverCmd.Flags().StringSliceVarP(&cors.AllowedMethods, "cors-methods", "", setCORSMethods(), "methods cross-origin requests may use")
+	serverCmd.Flags().StringSliceVarP(&cors.AllowedHeaders, "cors-headers", "", setCORSHeaders(), "headers cross-origin requests may send")
+	serverCmd.Flags().DurationVarP(&cors.MaxAge, "cors-max-age", "", setCORSMaxAge(), "how long browsers may cache the answer to a preflight request")
+	serverCmd.Flags().StringVarP(&logLevel, "log-level", "", setLogLevel(), "debug, info, warn or error, overriding --verbose and --debug")
+	serverCmd.Flags().StringVarP(&logFormat, "log-format", "", setLogFormat(), "text or json")
+}
+
+func setServerConfigFile() string {
+	return os.Getenv(serverEnvPrefix + "CONFIG")
 }
 
 func setServerPort() uint64 {
@@ -76,6 +183,18 @@ func setSecurePort() uint64 {
 	return 9098
 }
 
+func setGRPCPort() uint64 {
+	return 0
+}
+
+func setListen() []string {
+	return []string{}
+}
+
+func setSocketMode() string {
+	return fmt.Sprintf("%04o", server.DefaultSocketMode)
+}
+
 func setSSL() bool {
 	return false
 }
@@ -91,3 +210,91 @@ func setDefaultServerCert() string {
 func setDefaultServerKey() string {
 	return ""
 }
+
+func setSelfSigned() bool {
+	return false
+}
+
+func setSelfSignedHosts() []string {
+	return []string{"localhost", "127.0.0.1", "::1"}
+}
+
+func setGracePeriod() time.Duration {
+	return 30 * time.Second
+}
+
+func setWorkers() int {
+	return runtime.NumCPU()
+}
+
+func setQueueSize() int {
+	return 64
+}
+
+func setQueueTimeout() time.Duration {
+	return 30 * time.Second
+}
+
+func setJobRetention() time.Duration {
+	return time.Hour
+}
+
+func setTokenFile() string {
+	return ""
+}
+
+func setClientCA() string {
+	return ""
+}
+
+func setRateRequests() float64 {
+	return 0
+}
+
+func setRateBytes() float64 {
+	return 0
+}
+
+func setRateCPU() time.Duration {
+	return 0
+}
+
+func setQuotaRequests() int64 {
+	return 0
+}
+
+func setQuotaBytes() int64 {
+	return 0
+}
+
+func setQuotaCPU() time.Duration {
+	return 0
+}
+
+func setMaxRequestSize() int64 {
+	return server.DefaultMaxRequestBytes
+}
+
+func setCORSOrigins() []string {
+	return []string{}
+}
+
+func setCORSMethods() []string {
+	return server.DefaultCORSMethods
+}
+
+func setCORSHeaders() []string {
+	return server.DefaultCORSHeaders
+}
+
+func setCORSMaxAge() time.Duration {
+	return 10 * time.Minute
+}
+
+func setLogLevel() string {
+	return ""
+}
+
+func setLogFormat() string {
+	return "text"
+}
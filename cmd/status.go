@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/monax/compilers/perform"
+
+	"github.com/monax/cli/log"
+
+	"github.com/spf13/cobra"
+)
+
+func BuildStatusCommand() {
+	CompilersCmd.AddCommand(statusCmd)
+	addStatusFlags()
+}
+
+var (
+	statusPort string
+	statusUrl  string
+	statusSSL  bool
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show the version, health and compilers of a compile server",
+	Run: func(cmd *cobra.Command, args []string) {
+		scheme := "http://"
+		if statusSSL {
+			scheme = "https://"
+		}
+		perform.Client = clientConfig("", statusUrl)
+		status, err := perform.RequestStatus(scheme + serverHost(statusUrl, statusPort) + "/")
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Version:  %s\n", status.Version.Version)
+		fmt.Printf("Health:   %s\n", status.Health.Status)
+		fmt.Printf("Features: %s\n", strings.Join(status.Compilers.Features, ", "))
+		for _, compiler := range status.Compilers.Compilers {
+			state := "not installed"
+			if health, ok := status.Health.Compilers[compiler.Language]; ok && !health.OK {
+				state = "not running: " + health.Error
+			} else if compiler.Installed {
+				state = compiler.Version
+			}
+			fmt.Printf("  %-10s %s", compiler.Language, state)
+			if len(compiler.Options) > 0 {
+				fmt.Printf(" (options: %s)", strings.Join(compiler.Options, ", "))
+			}
+			fmt.Println()
+		}
+		if status.Health.Status == perform.HealthDown {
+			os.Exit(1)
+		}
+	},
+}
+
+func addStatusFlags() {
+	statusCmd.Flags().StringVarP(&statusPort, "port", "p", setDefaultPort(), "call listening port")
+	statusCmd.Flags().StringVarP(&statusUrl, "url", "u", setDefaultURL(), "set the url of the compile server (no http(s) or port, please), or unix:<path> of its socket")
+	statusCmd.Flags().BoolVarP(&statusSSL, "ssl", "s", setCompilerSSL(), "call https")
+	addClientTLSFlags(statusCmd)
+}
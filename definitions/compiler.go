@@ -15,6 +15,13 @@ import (
 type Compiler struct {
 	Config LangConfig
 	Lang   string
+	// Contents of the files includes are read from by path, such as those
+	// sent by a browser. Includes are read from disk when nil.
+	Sources map[string][]byte
+	// include name, <sha256>.<lang>, of each file whose includes have been
+	// replaced, by path, so that a file imported along many paths is only
+	// replaced once
+	replaced map[string]string
 }
 
 // New Request object from script and map of include files
@@ -52,14 +59,21 @@ func (c *Compiler) ReplaceIncludes(code []byte, dir, file string,
 	// replace all includes with hash of included imports
 	// make sure to return hashes of includes so we can cache check them too
 	// do it recursively
+	var replaceErr error
 	code = regExpression.ReplaceAllFunc(code, func(s []byte) []byte {
 		log.WithField("=>", string(s)).Debug("Include Replacer result")
 		s, err := c.includeReplacer(regExpression, s, dir, includes, hashFileReplacement)
 		if err != nil {
 			log.Error("ERR!:", err)
+			if replaceErr == nil {
+				replaceErr = err
+			}
 		}
 		return s
 	})
+	if replaceErr != nil {
+		return nil, replaceErr
+	}
 
 	originHash := sha256.Sum256(code)
 	origin := hex.EncodeToString(originHash[:])
@@ -86,7 +100,12 @@ func (c *Compiler) includeReplacer(r *regexp.Regexp, originCode []byte, dir stri
 	log.WithField("=>", match).Debug("Match")
 	// load the file
 	newFilePath := path.Join(dir, match)
-	incl_code, err := ioutil.ReadFile(newFilePath)
+	if name, ok := c.replaced[newFilePath]; ok {
+		fullReplacement := strings.SplitAfter(m[0], m[2])
+		fullReplacement[1] = name + m[4]
+		return []byte(strings.Join(fullReplacement, "")), nil
+	}
+	incl_code, err := c.readFile(newFilePath)
 	if err != nil {
 		log.Errorln("failed to read include file", err)
 		return nil, fmt.Errorf("Failed to read include file: %s", err.Error())
@@ -114,6 +133,10 @@ func (c *Compiler) includeReplacer(r *regexp.Regexp, originCode []byte, dir stri
 	// compute hash
 	hash = sha256.Sum256(incl_code)
 	h := hex.EncodeToString(hash[:])
+	if c.replaced == nil {
+		c.replaced = make(map[string]string)
+	}
+	c.replaced[newFilePath] = h + "." + c.Lang
 
 	//Starting with full regex string,
 	//Split strings from the quotation mark and then,
@@ -124,6 +147,18 @@ func (c *Compiler) includeReplacer(r *regexp.Regexp, originCode []byte, dir stri
 	return ret, nil
 }
 
+// read an included file from Sources, or from disk if there are none
+func (c *Compiler) readFile(file string) ([]byte, error) {
+	if c.Sources == nil {
+		return ioutil.ReadFile(file)
+	}
+	code, ok := c.Sources[path.Clean(file)]
+	if !ok {
+		return nil, fmt.Errorf("no source for %s", file)
+	}
+	return code, nil
+}
+
 // Return the regex string to match include statements
 func (c *Compiler) IncludeRegex() string {
 	return c.Config.IncludeRegex
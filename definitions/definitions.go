@@ -12,6 +12,30 @@ type Request struct {
 	FileReplacement map[string]string         `json:"replacement"`
 }
 
+// Cache negotiation request, a compile request carrying only the hashes of
+// its includes. The server replies with what it has cached and which scripts
+// it still needs uploaded.
+type NegotiationRequest struct {
+	Language  string              `json:"language"`
+	Includes  map[string][]string `json:"includes"`  // include name to its object names
+	Libraries string              `json:"libraries"` // string of libName:LibAddr separated by comma
+	Optimize  bool                `json:"optimize"`  // run with optimize flag
+}
+
+// Strip the scripts from a request for cache negotiation
+func (r *Request) Negotiation() *NegotiationRequest {
+	includes := make(map[string][]string, len(r.Includes))
+	for name, include := range r.Includes {
+		includes[name] = include.ObjectNames
+	}
+	return &NegotiationRequest{
+		Language:  r.Language,
+		Includes:  includes,
+		Libraries: r.Libraries,
+		Optimize:  r.Optimize,
+	}
+}
+
 type BinaryRequest struct {
 	BinaryFile string `json:"binary"`
 	Libraries  string `json:"libraries"`
@@ -0,0 +1,695 @@
+// Code generated by protoc-gen-go.
+// source: compilers.proto
+// DO NOT EDIT!
+
+/*
+Package pb is a generated protocol buffer package.
+
+It is generated from these files:
+
+	compilers.proto
+
+It has these top-level messages:
+
+	CompileRequest
+	IncludedFiles
+	CompileResponse
+	ResponseItem
+	LinkRequest
+	LinkResponse
+	CompileEvent
+	ListCompilersRequest
+	ListCompilersResponse
+	CompilerInfo
+*/
+package pb
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+// definitions.Request
+type CompileRequest struct {
+	Name     string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Language string `protobuf:"bytes,2,opt,name=language" json:"language,omitempty"`
+	// include name, <sha256>.<lang>, to the include
+	Includes map[string]*IncludedFiles `protobuf:"bytes,3,rep,name=includes" json:"includes,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// libName:LibAddr separated by comma
+	Libraries string `protobuf:"bytes,4,opt,name=libraries" json:"libraries,omitempty"`
+	Optimize  bool   `protobuf:"varint,5,opt,name=optimize" json:"optimize,omitempty"`
+	// include name to the client's file name
+	Replacement map[string]string `protobuf:"bytes,6,rep,name=replacement" json:"replacement,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *CompileRequest) Reset()                    { *m = CompileRequest{} }
+func (m *CompileRequest) String() string            { return proto.CompactTextString(m) }
+func (*CompileRequest) ProtoMessage()               {}
+func (*CompileRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+func (m *CompileRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *CompileRequest) GetLanguage() string {
+	if m != nil {
+		return m.Language
+	}
+	return ""
+}
+
+func (m *CompileRequest) GetIncludes() map[string]*IncludedFiles {
+	if m != nil {
+		return m.Includes
+	}
+	return nil
+}
+
+func (m *CompileRequest) GetLibraries() string {
+	if m != nil {
+		return m.Libraries
+	}
+	return ""
+}
+
+func (m *CompileRequest) GetOptimize() bool {
+	if m != nil {
+		return m.Optimize
+	}
+	return false
+}
+
+func (m *CompileRequest) GetReplacement() map[string]string {
+	if m != nil {
+		return m.Replacement
+	}
+	return nil
+}
+
+// definitions.IncludedFiles
+type IncludedFiles struct {
+	ObjectNames []string `protobuf:"bytes,1,rep,name=object_names,json=objectNames" json:"object_names,omitempty"`
+	Script      []byte   `protobuf:"bytes,2,opt,name=script,proto3" json:"script,omitempty"`
+}
+
+func (m *IncludedFiles) Reset()                    { *m = IncludedFiles{} }
+func (m *IncludedFiles) String() string            { return proto.CompactTextString(m) }
+func (*IncludedFiles) ProtoMessage()               {}
+func (*IncludedFiles) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+func (m *IncludedFiles) GetObjectNames() []string {
+	if m != nil {
+		return m.ObjectNames
+	}
+	return nil
+}
+
+func (m *IncludedFiles) GetScript() []byte {
+	if m != nil {
+		return m.Script
+	}
+	return nil
+}
+
+// perform.Response
+type CompileResponse struct {
+	Objects []*ResponseItem `protobuf:"bytes,1,rep,name=objects" json:"objects,omitempty"`
+	Warning string          `protobuf:"bytes,2,opt,name=warning" json:"warning,omitempty"`
+	Version string          `protobuf:"bytes,3,opt,name=version" json:"version,omitempty"`
+	Error   string          `protobuf:"bytes,4,opt,name=error" json:"error,omitempty"`
+	Rebuilt []string        `protobuf:"bytes,5,rep,name=rebuilt" json:"rebuilt,omitempty"`
+	Cached  []string        `protobuf:"bytes,6,rep,name=cached" json:"cached,omitempty"`
+}
+
+func (m *CompileResponse) Reset()                    { *m = CompileResponse{} }
+func (m *CompileResponse) String() string            { return proto.CompactTextString(m) }
+func (*CompileResponse) ProtoMessage()               {}
+func (*CompileResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *CompileResponse) GetObjects() []*ResponseItem {
+	if m != nil {
+		return m.Objects
+	}
+	return nil
+}
+
+func (m *CompileResponse) GetWarning() string {
+	if m != nil {
+		return m.Warning
+	}
+	return ""
+}
+
+func (m *CompileResponse) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *CompileResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *CompileResponse) GetRebuilt() []string {
+	if m != nil {
+		return m.Rebuilt
+	}
+	return nil
+}
+
+func (m *CompileResponse) GetCached() []string {
+	if m != nil {
+		return m.Cached
+	}
+	return nil
+}
+
+// perform.ResponseItem
+type ResponseItem struct {
+	Objectname string `protobuf:"bytes,1,opt,name=objectname" json:"objectname,omitempty"`
+	Bytecode   string `protobuf:"bytes,2,opt,name=bytecode" json:"bytecode,omitempty"`
+	// json encoded
+	Abi string `protobuf:"bytes,3,opt,name=abi" json:"abi,omitempty"`
+}
+
+func (m *ResponseItem) Reset()                    { *m = ResponseItem{} }
+func (m *ResponseItem) String() string            { return proto.CompactTextString(m) }
+func (*ResponseItem) ProtoMessage()               {}
+func (*ResponseItem) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *ResponseItem) GetObjectname() string {
+	if m != nil {
+		return m.Objectname
+	}
+	return ""
+}
+
+func (m *ResponseItem) GetBytecode() string {
+	if m != nil {
+		return m.Bytecode
+	}
+	return ""
+}
+
+func (m *ResponseItem) GetAbi() string {
+	if m != nil {
+		return m.Abi
+	}
+	return ""
+}
+
+// definitions.BinaryRequest
+type LinkRequest struct {
+	Binary    string `protobuf:"bytes,1,opt,name=binary" json:"binary,omitempty"`
+	Libraries string `protobuf:"bytes,2,opt,name=libraries" json:"libraries,omitempty"`
+}
+
+func (m *LinkRequest) Reset()                    { *m = LinkRequest{} }
+func (m *LinkRequest) String() string            { return proto.CompactTextString(m) }
+func (*LinkRequest) ProtoMessage()               {}
+func (*LinkRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *LinkRequest) GetBinary() string {
+	if m != nil {
+		return m.Binary
+	}
+	return ""
+}
+
+func (m *LinkRequest) GetLibraries() string {
+	if m != nil {
+		return m.Libraries
+	}
+	return ""
+}
+
+// perform.BinaryResponse
+type LinkResponse struct {
+	Binary string `protobuf:"bytes,1,opt,name=binary" json:"binary,omitempty"`
+	Error  string `protobuf:"bytes,2,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *LinkResponse) Reset()                    { *m = LinkResponse{} }
+func (m *LinkResponse) String() string            { return proto.CompactTextString(m) }
+func (*LinkResponse) ProtoMessage()               {}
+func (*LinkResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *LinkResponse) GetBinary() string {
+	if m != nil {
+		return m.Binary
+	}
+	return ""
+}
+
+func (m *LinkResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+// perform.CompileEvent
+type CompileEvent struct {
+	Type     string           `protobuf:"bytes,1,opt,name=type" json:"type,omitempty"`
+	Include  string           `protobuf:"bytes,2,opt,name=include" json:"include,omitempty"`
+	File     string           `protobuf:"bytes,3,opt,name=file" json:"file,omitempty"`
+	Imports  []string         `protobuf:"bytes,4,rep,name=imports" json:"imports,omitempty"`
+	Severity string           `protobuf:"bytes,5,opt,name=severity" json:"severity,omitempty"`
+	Message  string           `protobuf:"bytes,6,opt,name=message" json:"message,omitempty"`
+	Response *CompileResponse `protobuf:"bytes,7,opt,name=response" json:"response,omitempty"`
+}
+
+func (m *CompileEvent) Reset()                    { *m = CompileEvent{} }
+func (m *CompileEvent) String() string            { return proto.CompactTextString(m) }
+func (*CompileEvent) ProtoMessage()               {}
+func (*CompileEvent) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *CompileEvent) GetType() string {
+	if m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+func (m *CompileEvent) GetInclude() string {
+	if m != nil {
+		return m.Include
+	}
+	return ""
+}
+
+func (m *CompileEvent) GetFile() string {
+	if m != nil {
+		return m.File
+	}
+	return ""
+}
+
+func (m *CompileEvent) GetImports() []string {
+	if m != nil {
+		return m.Imports
+	}
+	return nil
+}
+
+func (m *CompileEvent) GetSeverity() string {
+	if m != nil {
+		return m.Severity
+	}
+	return ""
+}
+
+func (m *CompileEvent) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
+func (m *CompileEvent) GetResponse() *CompileResponse {
+	if m != nil {
+		return m.Response
+	}
+	return nil
+}
+
+type ListCompilersRequest struct {
+}
+
+func (m *ListCompilersRequest) Reset()                    { *m = ListCompilersRequest{} }
+func (m *ListCompilersRequest) String() string            { return proto.CompactTextString(m) }
+func (*ListCompilersRequest) ProtoMessage()               {}
+func (*ListCompilersRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+// perform.CompilersResponse
+type ListCompilersResponse struct {
+	Compilers   []*CompilerInfo `protobuf:"bytes,1,rep,name=compilers" json:"compilers,omitempty"`
+	Features    []string        `protobuf:"bytes,2,rep,name=features" json:"features,omitempty"`
+	ApiVersions []string        `protobuf:"bytes,3,rep,name=api_versions,json=apiVersions" json:"api_versions,omitempty"`
+}
+
+func (m *ListCompilersResponse) Reset()                    { *m = ListCompilersResponse{} }
+func (m *ListCompilersResponse) String() string            { return proto.CompactTextString(m) }
+func (*ListCompilersResponse) ProtoMessage()               {}
+func (*ListCompilersResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *ListCompilersResponse) GetCompilers() []*CompilerInfo {
+	if m != nil {
+		return m.Compilers
+	}
+	return nil
+}
+
+func (m *ListCompilersResponse) GetFeatures() []string {
+	if m != nil {
+		return m.Features
+	}
+	return nil
+}
+
+func (m *ListCompilersResponse) GetApiVersions() []string {
+	if m != nil {
+		return m.ApiVersions
+	}
+	return nil
+}
+
+// perform.CompilerInfo
+type CompilerInfo struct {
+	Language  string   `protobuf:"bytes,1,opt,name=language" json:"language,omitempty"`
+	Installed bool     `protobuf:"varint,2,opt,name=installed" json:"installed,omitempty"`
+	Version   string   `protobuf:"bytes,3,opt,name=version" json:"version,omitempty"`
+	Options   []string `protobuf:"bytes,4,rep,name=options" json:"options,omitempty"`
+}
+
+func (m *CompilerInfo) Reset()                    { *m = CompilerInfo{} }
+func (m *CompilerInfo) String() string            { return proto.CompactTextString(m) }
+func (*CompilerInfo) ProtoMessage()               {}
+func (*CompilerInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *CompilerInfo) GetLanguage() string {
+	if m != nil {
+		return m.Language
+	}
+	return ""
+}
+
+func (m *CompilerInfo) GetInstalled() bool {
+	if m != nil {
+		return m.Installed
+	}
+	return false
+}
+
+func (m *CompilerInfo) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *CompilerInfo) GetOptions() []string {
+	if m != nil {
+		return m.Options
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*CompileRequest)(nil), "compilers.CompileRequest")
+	proto.RegisterType((*IncludedFiles)(nil), "compilers.IncludedFiles")
+	proto.RegisterType((*CompileResponse)(nil), "compilers.CompileResponse")
+	proto.RegisterType((*ResponseItem)(nil), "compilers.ResponseItem")
+	proto.RegisterType((*LinkRequest)(nil), "compilers.LinkRequest")
+	proto.RegisterType((*LinkResponse)(nil), "compilers.LinkResponse")
+	proto.RegisterType((*CompileEvent)(nil), "compilers.CompileEvent")
+	proto.RegisterType((*ListCompilersRequest)(nil), "compilers.ListCompilersRequest")
+	proto.RegisterType((*ListCompilersResponse)(nil), "compilers.ListCompilersResponse")
+	proto.RegisterType((*CompilerInfo)(nil), "compilers.CompilerInfo")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for Compilers service
+
+type CompilersClient interface {
+	// Compile a request and answer with the compiled objects. A failed compile
+	// is answered with the compiler's output in the response's error.
+	Compile(ctx context.Context, in *CompileRequest, opts ...grpc.CallOption) (*CompileResponse, error)
+	// Link libraries into a binary
+	Link(ctx context.Context, in *LinkRequest, opts ...grpc.CallOption) (*LinkResponse, error)
+	// Compile a request, streaming its progress. The last event is of type
+	// "response" and carries the response.
+	CompileStream(ctx context.Context, in *CompileRequest, opts ...grpc.CallOption) (Compilers_CompileStreamClient, error)
+	// Languages and features the server supports
+	ListCompilers(ctx context.Context, in *ListCompilersRequest, opts ...grpc.CallOption) (*ListCompilersResponse, error)
+}
+
+type compilersClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewCompilersClient(cc *grpc.ClientConn) CompilersClient {
+	return &compilersClient{cc}
+}
+
+func (c *compilersClient) Compile(ctx context.Context, in *CompileRequest, opts ...grpc.CallOption) (*CompileResponse, error) {
+	out := new(CompileResponse)
+	err := grpc.Invoke(ctx, "/compilers.Compilers/Compile", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *compilersClient) Link(ctx context.Context, in *LinkRequest, opts ...grpc.CallOption) (*LinkResponse, error) {
+	out := new(LinkResponse)
+	err := grpc.Invoke(ctx, "/compilers.Compilers/Link", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *compilersClient) CompileStream(ctx context.Context, in *CompileRequest, opts ...grpc.CallOption) (Compilers_CompileStreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Compilers_serviceDesc.Streams[0], c.cc, "/compilers.Compilers/CompileStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &compilersCompileStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Compilers_CompileStreamClient interface {
+	Recv() (*CompileEvent, error)
+	grpc.ClientStream
+}
+
+type compilersCompileStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *compilersCompileStreamClient) Recv() (*CompileEvent, error) {
+	m := new(CompileEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *compilersClient) ListCompilers(ctx context.Context, in *ListCompilersRequest, opts ...grpc.CallOption) (*ListCompilersResponse, error) {
+	out := new(ListCompilersResponse)
+	err := grpc.Invoke(ctx, "/compilers.Compilers/ListCompilers", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Compilers service
+
+type CompilersServer interface {
+	// Compile a request and answer with the compiled objects. A failed compile
+	// is answered with the compiler's output in the response's error.
+	Compile(context.Context, *CompileRequest) (*CompileResponse, error)
+	// Link libraries into a binary
+	Link(context.Context, *LinkRequest) (*LinkResponse, error)
+	// Compile a request, streaming its progress. The last event is of type
+	// "response" and carries the response.
+	CompileStream(*CompileRequest, Compilers_CompileStreamServer) error
+	// Languages and features the server supports
+	ListCompilers(context.Context, *ListCompilersRequest) (*ListCompilersResponse, error)
+}
+
+func RegisterCompilersServer(s *grpc.Server, srv CompilersServer) {
+	s.RegisterService(&_Compilers_serviceDesc, srv)
+}
+
+func _Compilers_Compile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CompilersServer).Compile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/compilers.Compilers/Compile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CompilersServer).Compile(ctx, req.(*CompileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Compilers_Link_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LinkRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CompilersServer).Link(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/compilers.Compilers/Link",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CompilersServer).Link(ctx, req.(*LinkRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Compilers_CompileStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(CompileRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CompilersServer).CompileStream(m, &compilersCompileStreamServer{stream})
+}
+
+type Compilers_CompileStreamServer interface {
+	Send(*CompileEvent) error
+	grpc.ServerStream
+}
+
+type compilersCompileStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *compilersCompileStreamServer) Send(m *CompileEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Compilers_ListCompilers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCompilersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CompilersServer).ListCompilers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/compilers.Compilers/ListCompilers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CompilersServer).ListCompilers(ctx, req.(*ListCompilersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Compilers_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "compilers.Compilers",
+	HandlerType: (*CompilersServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Compile",
+			Handler:    _Compilers_Compile_Handler,
+		},
+		{
+			MethodName: "Link",
+			Handler:    _Compilers_Link_Handler,
+		},
+		{
+			MethodName: "ListCompilers",
+			Handler:    _Compilers_ListCompilers_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "CompileStream",
+			Handler:       _Compilers_CompileStream_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "compilers.proto",
+}
+
+func init() { proto.RegisterFile("compilers.proto", fileDescriptor0) }
+
+var fileDescriptor0 = []byte{
+	// 737 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x55, 0xdd, 0x6e, 0xd3, 0x4a,
+	0x10, 0x96, 0x93, 0x34, 0x89, 0x27, 0xc9, 0x69, 0xb5, 0xea, 0x49, 0x7d, 0xa2, 0xea, 0x10, 0x7c,
+	0x43, 0xc4, 0x45, 0x04, 0x41, 0xfc, 0x08, 0x21, 0x84, 0x88, 0x8a, 0x54, 0x54, 0x71, 0xb1, 0x08,
+	0x2e, 0x10, 0x52, 0xb5, 0x76, 0xb6, 0x65, 0xa9, 0xbd, 0x36, 0xbb, 0x9b, 0xa0, 0x20, 0x5e, 0x81,
+	0x87, 0x40, 0xe2, 0x41, 0x78, 0x0c, 0x1e, 0x07, 0xed, 0x8f, 0x1d, 0x27, 0x4d, 0x7a, 0xb7, 0xdf,
+	0xf8, 0x9b, 0xd9, 0x99, 0x6f, 0x66, 0xd6, 0xb0, 0x1f, 0x67, 0x69, 0xce, 0x12, 0x2a, 0xe4, 0x38,
+	0x17, 0x99, 0xca, 0x90, 0x5f, 0x1a, 0xc2, 0x5f, 0x75, 0xf8, 0x67, 0x6a, 0x11, 0xa6, 0x5f, 0xe6,
+	0x54, 0x2a, 0x84, 0xa0, 0xc1, 0x49, 0x4a, 0x03, 0x6f, 0xe8, 0x8d, 0x7c, 0x6c, 0xce, 0x68, 0x00,
+	0xed, 0x84, 0xf0, 0xcb, 0x39, 0xb9, 0xa4, 0x41, 0xcd, 0xd8, 0x4b, 0x8c, 0xa6, 0xd0, 0x66, 0x3c,
+	0x4e, 0xe6, 0x33, 0x2a, 0x83, 0xfa, 0xb0, 0x3e, 0xea, 0x4c, 0xee, 0x8c, 0x57, 0x37, 0xae, 0x07,
+	0x1f, 0x9f, 0x3a, 0xe6, 0x09, 0x57, 0x62, 0x89, 0x4b, 0x47, 0x74, 0x0c, 0x7e, 0xc2, 0x22, 0x41,
+	0x04, 0xa3, 0x32, 0x68, 0x98, 0x1b, 0x56, 0x06, 0x7d, 0x7d, 0x96, 0x2b, 0x96, 0xb2, 0x6f, 0x34,
+	0xd8, 0x1b, 0x7a, 0xa3, 0x36, 0x2e, 0x31, 0x3a, 0x83, 0x8e, 0xa0, 0x79, 0x42, 0x62, 0x9a, 0x52,
+	0xae, 0x82, 0xa6, 0xc9, 0xe0, 0xee, 0xee, 0x0c, 0xf0, 0x8a, 0x6c, 0x93, 0xa8, 0xba, 0x0f, 0xde,
+	0x41, 0x6f, 0x2d, 0x45, 0x74, 0x00, 0xf5, 0x2b, 0xba, 0x74, 0x62, 0xe8, 0x23, 0x1a, 0xc3, 0xde,
+	0x82, 0x24, 0x73, 0x2b, 0x44, 0x67, 0x12, 0x54, 0xae, 0x72, 0xae, 0xb3, 0x57, 0x2c, 0xa1, 0x12,
+	0x5b, 0xda, 0xd3, 0xda, 0x13, 0x6f, 0xf0, 0x1c, 0x0e, 0x36, 0xef, 0xdd, 0x12, 0xf9, 0xb0, 0x1a,
+	0xd9, 0xaf, 0xf8, 0x87, 0xaf, 0xa1, 0xb7, 0x16, 0x1b, 0xdd, 0x86, 0x6e, 0x16, 0x7d, 0xa6, 0xb1,
+	0x3a, 0xd7, 0xfd, 0x91, 0x81, 0x37, 0xac, 0x8f, 0x7c, 0xdc, 0xb1, 0xb6, 0x37, 0xda, 0x84, 0xfa,
+	0xd0, 0x94, 0xb1, 0x60, 0xb9, 0x32, 0xe1, 0xba, 0xd8, 0xa1, 0xf0, 0xb7, 0x07, 0xfb, 0xa5, 0x26,
+	0x32, 0xcf, 0xb8, 0xa4, 0xe8, 0x3e, 0xb4, 0xac, 0xab, 0x8d, 0xd4, 0x99, 0x1c, 0x55, 0xaa, 0x2a,
+	0x58, 0xa7, 0x8a, 0xa6, 0xb8, 0xe0, 0xa1, 0x00, 0x5a, 0x5f, 0x89, 0xe0, 0x8c, 0x5f, 0xba, 0x74,
+	0x0b, 0xa8, 0xbf, 0x2c, 0xa8, 0x90, 0x2c, 0xe3, 0x41, 0xdd, 0x7e, 0x71, 0x50, 0x17, 0x48, 0x85,
+	0xc8, 0x84, 0xeb, 0xb0, 0x05, 0x9a, 0x2f, 0x68, 0x34, 0x67, 0x89, 0x0a, 0xf6, 0x4c, 0x19, 0x05,
+	0xd4, 0x25, 0xc4, 0x24, 0xfe, 0x44, 0x67, 0xa6, 0xad, 0x3e, 0x76, 0x28, 0xfc, 0x08, 0xdd, 0x6a,
+	0x52, 0xe8, 0x7f, 0x00, 0x9b, 0x56, 0x65, 0x70, 0x2b, 0x16, 0x3d, 0x3f, 0xd1, 0x52, 0xd1, 0x38,
+	0x9b, 0x95, 0xe3, 0x5b, 0x60, 0xdd, 0x06, 0x12, 0x31, 0x97, 0xa9, 0x3e, 0x86, 0x53, 0xe8, 0x9c,
+	0x31, 0x7e, 0x55, 0xec, 0x43, 0x1f, 0x9a, 0x11, 0xe3, 0x44, 0x14, 0xad, 0x72, 0x68, 0x7d, 0x64,
+	0x6b, 0x1b, 0x23, 0x1b, 0x3e, 0x83, 0xae, 0x0d, 0xe2, 0x14, 0xde, 0x15, 0xa5, 0x94, 0xa4, 0x56,
+	0x91, 0x24, 0xfc, 0xe3, 0x41, 0xd7, 0xf5, 0xe8, 0x64, 0x41, 0xb9, 0x59, 0x4a, 0xb5, 0xcc, 0xcb,
+	0xa5, 0xd4, 0x67, 0xad, 0x9b, 0xdb, 0x9f, 0xa2, 0x03, 0x0e, 0x6a, 0xf6, 0x05, 0x4b, 0xa8, 0x2b,
+	0xca, 0x9c, 0x0d, 0x3b, 0xcd, 0x33, 0xa1, 0xf4, 0x7e, 0x19, 0x95, 0x1d, 0xd4, 0xea, 0x48, 0xba,
+	0xa0, 0x82, 0xa9, 0xa5, 0xd9, 0x2e, 0x1f, 0x97, 0x58, 0x7b, 0xa5, 0x54, 0x4a, 0xbd, 0xf7, 0x4d,
+	0x7b, 0x87, 0x83, 0xe8, 0x11, 0xb4, 0x85, 0x2b, 0x2e, 0x68, 0x99, 0x4d, 0x18, 0x6c, 0x5b, 0x3a,
+	0xcb, 0xc0, 0x25, 0x37, 0xec, 0xc3, 0xe1, 0x19, 0x93, 0x6a, 0x5a, 0x50, 0x9d, 0xcc, 0xe1, 0x0f,
+	0x0f, 0xfe, 0xdd, 0xf8, 0xe0, 0xa4, 0x7b, 0x08, 0xab, 0x07, 0x6b, 0xcb, 0x78, 0x16, 0x0e, 0xa7,
+	0xfc, 0x22, 0xc3, 0x2b, 0xa6, 0x2e, 0xeb, 0x82, 0x12, 0x35, 0x17, 0xa6, 0x3d, 0xba, 0xe2, 0x12,
+	0xeb, 0xf5, 0x21, 0x39, 0x3b, 0x77, 0x73, 0x69, 0xdf, 0x2d, 0x1f, 0x77, 0x48, 0xce, 0xde, 0x3b,
+	0x53, 0xf8, 0x1d, 0xba, 0xd5, 0xc8, 0x6b, 0x4f, 0xa0, 0xb7, 0xf1, 0x04, 0x1e, 0x83, 0xcf, 0xb8,
+	0x54, 0x24, 0x49, 0xe8, 0xcc, 0xf4, 0xa2, 0x8d, 0x57, 0x86, 0x1b, 0xf6, 0x21, 0x80, 0x96, 0x7e,
+	0xc7, 0x32, 0x5e, 0xf6, 0xc4, 0xc1, 0xc9, 0xcf, 0x1a, 0xf8, 0xa5, 0x12, 0xe8, 0x05, 0xb4, 0x1c,
+	0x40, 0xff, 0xed, 0x7c, 0xd9, 0x06, 0x37, 0xe8, 0x8f, 0x1e, 0x43, 0x43, 0x8f, 0x23, 0xea, 0x57,
+	0x38, 0x95, 0x21, 0x1f, 0x1c, 0x5d, 0xb3, 0x3b, 0xc7, 0x13, 0xe8, 0xb9, 0x58, 0x6f, 0x95, 0xa0,
+	0x24, 0xbd, 0x29, 0x81, 0x2d, 0x5d, 0x31, 0xd3, 0x7b, 0xcf, 0x43, 0x18, 0x7a, 0x6b, 0xcd, 0x45,
+	0xb7, 0xd6, 0x2e, 0xbc, 0x3e, 0x0f, 0x83, 0xe1, 0x6e, 0x82, 0x4d, 0xed, 0x65, 0xe3, 0x43, 0x2d,
+	0x8f, 0xa2, 0xa6, 0xf9, 0xa7, 0x3d, 0xf8, 0x3b, 0x00, 0xd0, 0x95, 0x3e, 0x12, 0xe6, 0x06, 0x00,
+	0x00,
+}
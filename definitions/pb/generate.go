@@ -0,0 +1,9 @@
+package pb
+
+// compilers.pb.go is generated from compilers.proto by protoc and the
+// protoc-gen-go vendored with the github.com/golang/protobuf it is compiled
+// against. Run go generate here after editing compilers.proto.
+
+//go:generate go build -o protoc-gen-go ../../vendor/github.com/golang/protobuf/protoc-gen-go
+//go:generate protoc --plugin=protoc-gen-go=./protoc-gen-go --go_out=plugins=grpc:. compilers.proto
+//go:generate rm protoc-gen-go
@@ -0,0 +1,102 @@
+// Package v1 holds the wire types of version 1 of the compile server API,
+// served under /v1. Old clients depend on them, so rather than change them
+// add a new version.
+package v1
+
+import "time"
+
+// Route prefix of the version
+const Version = "v1"
+
+// Request of /v1/compile, and of /v1/jobs
+type CompileRequest struct {
+	Name            string              `json:"name"`
+	Language        string              `json:"language"`
+	Includes        map[string]*Include `json:"includes"`    // include name, <sha256>.<lang>, to the include
+	Libraries       string              `json:"libraries"`   // libName:LibAddr separated by comma
+	Optimize        bool                `json:"optimize"`    // run with optimize flag
+	FileReplacement map[string]string   `json:"replacement"` // include name to the client's file name
+}
+
+// A script and the objects it defines. The script may be left out if the
+// server holds it, see NegotiationResponse.
+type Include struct {
+	ObjectNames []string `json:"objectNames"`
+	Script      []byte   `json:"script"`
+}
+
+// Request of /v1/sources, a compile of sources sent as they are, such as by
+// a browser, rather than named after their hashes. Replied to with a
+// CompileResponse.
+type SourcesRequest struct {
+	Language string            `json:"language"` // defaults to the extension of Main
+	Sources  map[string]string `json:"sources"`  // path of each source to its content
+	// sources to compile, along with those they import; defaults to all
+	Main      []string `json:"main,omitempty"`
+	Libraries string   `json:"libraries"`
+	Optimize  bool     `json:"optimize"`
+}
+
+// Reply of /v1/compile
+type CompileResponse struct {
+	Objects []Object `json:"objects"`
+	Warning string   `json:"warning"`
+	Version string   `json:"version"`
+	Rebuilt []string `json:"rebuilt,omitempty"` // names of the objects which were compiled
+	Cached  []string `json:"cached,omitempty"`  // names of the objects served from the cache
+}
+
+// A compiled object
+type Object struct {
+	Objectname string `json:"objectname"`
+	Bytecode   string `json:"bytecode"`
+	ABI        string `json:"abi"` // json encoded
+}
+
+// Request of /v1/negotiate, a compile request carrying only the names of its
+// includes
+type NegotiationRequest struct {
+	Language  string              `json:"language"`
+	Includes  map[string][]string `json:"includes"` // include name to its object names
+	Libraries string              `json:"libraries"`
+	Optimize  bool                `json:"optimize"`
+}
+
+// Reply of /v1/negotiate
+type NegotiationResponse struct {
+	Objects []Object `json:"objects"` // cached objects of the includes not in Missing
+	Missing []string `json:"missing"` // includes without cached results
+	Needed  []string `json:"needed"`  // includes whose scripts must be uploaded
+}
+
+// Request of /v1/link
+type LinkRequest struct {
+	Binary    string `json:"binary"`
+	Libraries string `json:"libraries"`
+}
+
+// Reply of /v1/link
+type LinkResponse struct {
+	Binary string `json:"binary"`
+}
+
+// Compile job, the reply of /v1/jobs and /v1/jobs/{id}
+type Job struct {
+	ID       string           `json:"id"`
+	Status   string           `json:"status"` // queued, running, done or failed
+	Response *CompileResponse `json:"response,omitempty"`
+	Error    *ErrorBody       `json:"error,omitempty"` // why a failed job failed
+	Created  time.Time        `json:"created"`
+	Finished *time.Time       `json:"finished,omitempty"`
+}
+
+// Body of every error reply
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
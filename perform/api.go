@@ -0,0 +1,279 @@
+package perform
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/definitions/v1"
+
+	"github.com/monax/cli/log"
+)
+
+// API versions served under their own route prefix, oldest first
+var serverAPIVersions = []string{v1.Version}
+
+// API versions the client speaks, newest first
+var clientAPIVersions = []string{v1.Version}
+
+// Compile handler of API version 1
+// Answers 422 Unprocessable Entity with the compiler's output if the compile
+// fails
+func (s *Server) CompileV1Handler(w http.ResponseWriter, r *http.Request) {
+	resp := s.compileResponse(w, r)
+	if resp == nil {
+		return
+	}
+	if resp.Error != "" {
+		writeCompileError(w, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, responseToV1(resp))
+}
+
+// Link handler of API version 1
+// Answers 422 Unprocessable Entity if the linker rejects the binary
+func (s *Server) LinkV1Handler(w http.ResponseWriter, r *http.Request) {
+	resp := s.linkResponse(w, r)
+	if resp == nil {
+		return
+	}
+	if resp.Error != "" {
+		writeError(w, http.StatusUnprocessableEntity, CodeCompileFailed, resp.Error)
+		return
+	}
+	writeJSON(w, http.StatusOK, &v1.LinkResponse{Binary: resp.Binary})
+}
+
+// Jobs handler of API version 1, see JobsHandler
+func (s *Server) JobsV1Handler(w http.ResponseWriter, r *http.Request) {
+	s.serveJobs(w, r, "/"+v1.Version+"/jobs", func(w http.ResponseWriter, status int, j Job) {
+		writeJSON(w, status, jobToV1(j))
+	})
+}
+
+// Answers routes under a version prefix which do not exist, rather than
+// leaving them to the legacy compile route
+func unknownRouteHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, CodeNotFound, "no such route "+r.URL.Path)
+}
+
+func objectsToV1(items []ResponseItem) []v1.Object {
+	objects := make([]v1.Object, len(items))
+	for i, item := range items {
+		objects[i] = v1.Object(item)
+	}
+	return objects
+}
+
+func objectsFromV1(objects []v1.Object) []ResponseItem {
+	items := make([]ResponseItem, len(objects))
+	for i, object := range objects {
+		items[i] = ResponseItem(object)
+	}
+	return items
+}
+
+func requestToV1(req *definitions.Request) *v1.CompileRequest {
+	includes := make(map[string]*v1.Include, len(req.Includes))
+	for name, include := range req.Includes {
+		if include != nil {
+			includes[name] = &v1.Include{ObjectNames: include.ObjectNames, Script: include.Script}
+		} else {
+			includes[name] = nil
+		}
+	}
+	return &v1.CompileRequest{
+		Name:            req.ScriptName,
+		Language:        req.Language,
+		Includes:        includes,
+		Libraries:       req.Libraries,
+		Optimize:        req.Optimize,
+		FileReplacement: req.FileReplacement,
+	}
+}
+
+func requestFromV1(req *v1.CompileRequest) *definitions.Request {
+	includes := make(map[string]*definitions.IncludedFiles, len(req.Includes))
+	for name, include := range req.Includes {
+		if include != nil {
+			includes[name] = &definitions.IncludedFiles{ObjectNames: include.ObjectNames, Script: include.Script}
+		} else {
+			includes[name] = nil
+		}
+	}
+	return &definitions.Request{
+		ScriptName:      req.Name,
+		Language:        req.Language,
+		Includes:        includes,
+		Libraries:       req.Libraries,
+		Optimize:        req.Optimize,
+		FileReplacement: req.FileReplacement,
+	}
+}
+
+func responseToV1(resp *Response) *v1.CompileResponse {
+	return &v1.CompileResponse{
+		Objects: objectsToV1(resp.Objects),
+		Warning: resp.Warning,
+		Version: resp.Version,
+		Rebuilt: resp.Rebuilt,
+		Cached:  resp.Cached,
+	}
+}
+
+func responseFromV1(resp *v1.CompileResponse) *Response {
+	return &Response{
+		Objects: objectsFromV1(resp.Objects),
+		Warning: resp.Warning,
+		Version: resp.Version,
+		Rebuilt: resp.Rebuilt,
+		Cached:  resp.Cached,
+	}
+}
+
+func negotiationFromV1(req *v1.NegotiationRequest) *definitions.NegotiationRequest {
+	return &definitions.NegotiationRequest{
+		Language:  req.Language,
+		Includes:  req.Includes,
+		Libraries: req.Libraries,
+		Optimize:  req.Optimize,
+	}
+}
+
+func negotiationResponseToV1(resp *NegotiationResponse) *v1.NegotiationResponse {
+	return &v1.NegotiationResponse{
+		Objects: objectsToV1(resp.Objects),
+		Missing: resp.Missing,
+		Needed:  resp.Needed,
+	}
+}
+
+func linkRequestFromV1(req *v1.LinkRequest) *definitions.BinaryRequest {
+	return &definitions.BinaryRequest{
+		BinaryFile: req.Binary,
+		Libraries:  req.Libraries,
+	}
+}
+
+func jobToV1(j Job) *v1.Job {
+	job := &v1.Job{
+		ID:       j.ID,
+		Status:   string(j.Status),
+		Created:  j.Created,
+		Finished: j.Finished,
+	}
+	if j.Status == JobDone && j.Response != nil {
+		job.Response = responseToV1(j.Response)
+	}
+	if j.Status == JobFailed {
+		job.Error = &v1.ErrorBody{Code: j.Code, Message: j.Error}
+		if j.Response != nil {
+			for _, diagnostic := range diagnostics(j.Response.Error, nil) {
+				job.Error.Details = append(job.Error.Details, diagnostic.Message)
+			}
+		}
+	}
+	return job
+}
+
+func jobFromV1(job *v1.Job) *Job {
+	j := &Job{
+		ID:       job.ID,
+		Status:   JobStatus(job.Status),
+		Created:  job.Created,
+		Finished: job.Finished,
+	}
+	if job.Response != nil {
+		j.Response = responseFromV1(job.Response)
+	}
+	if job.Error != nil {
+		j.Code = job.Error.Code
+		j.Error = job.Error.Message
+	}
+	return j
+}
+
+// Routes of a compile server for the newest API version both it and the
+// client speak
+type serverAPI struct {
+	// compile route of the server, the other routes are relative to it
+	base string
+	// empty for servers which predate versioned routes
+	version string
+}
+
+func (api serverAPI) route(name string) string {
+	if api.version == "" {
+		switch name {
+		case "compile":
+			return api.base
+		case "link":
+			return routeURL(api.base, "binaries")
+		}
+		return routeURL(api.base, name)
+	}
+	return routeURL(api.base, api.version, name)
+}
+
+// compile req and wait for the response
+func (api serverAPI) compile(ctx context.Context, req *definitions.Request) (*Response, error) {
+	if api.version == "" {
+		return requestResponse(ctx, req, api.base)
+	}
+	return requestV1Response(ctx, req, api.route("compile"))
+}
+
+// compile req as a job, polling it until it finishes
+func (api serverAPI) compileJob(ctx context.Context, req *definitions.Request) (*Response, error) {
+	return requestJobResponse(ctx, req, api)
+}
+
+var (
+	serverAPIsLock sync.Mutex
+	serverAPIs     = make(map[string]serverAPI)
+)
+
+// Ask the server whose compile route is base which API versions it speaks
+// through the compilers endpoint. Servers which do not say are spoken to
+// through the legacy routes. Only a definitive answer is remembered: the
+// endpoint answering, or there being no such route.
+func discoverAPI(ctx context.Context, base string) serverAPI {
+	serverAPIsLock.Lock()
+	api, ok := serverAPIs[base]
+	serverAPIsLock.Unlock()
+	if ok {
+		return api
+	}
+	api = serverAPI{base: base}
+	compilers := new(CompilersResponse)
+	err := doJSON(ctx, "GET", routeURL(base, "compilers"), nil, compilers)
+	if serverErr, ok := err.(*ServerError); err != nil && (!ok || serverErr.StatusCode != http.StatusNotFound) {
+		// try again next time, the server may not be up yet or be failing
+		// for the moment
+		log.WithField("err", err).Debug("Could not discover the API of the server")
+		return api
+	}
+	for _, version := range clientAPIVersions {
+		for _, served := range compilers.APIVersions {
+			if version == served && api.version == "" {
+				api.version = version
+			}
+		}
+	}
+	log.WithFields(log.Fields{
+		"server":  base,
+		"version": api.version,
+	}).Debug("Discovered API version")
+	serverAPIsLock.Lock()
+	serverAPIs[base] = api
+	serverAPIsLock.Unlock()
+	return api
+}
+
+// the compile route of the server a link URL, ending in /binaries, belongs to
+func linkBase(linkURL string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(linkURL, "/"), "/binaries")
+}
@@ -0,0 +1,155 @@
+package perform
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/definitions/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestV1Routes(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	interval := JobPollInterval
+	JobPollInterval = 10 * time.Millisecond
+	defer func() { JobPollInterval = interval }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.CompileHandler)
+	mux.HandleFunc("/compilers", CompilersHandler)
+	mux.HandleFunc("/v1/", unknownRouteHandler)
+	mux.HandleFunc("/v1/compile", server.CompileV1Handler)
+	mux.HandleFunc("/v1/link", server.LinkV1Handler)
+	mux.HandleFunc("/v1/negotiate", server.NegotiateHandler)
+	mux.HandleFunc("/v1/jobs", server.JobsV1Handler)
+	mux.HandleFunc("/v1/jobs/", server.JobsV1Handler)
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	api := discoverAPI(context.Background(), testServer.URL)
+	assert.Equal(t, v1.Version, api.version)
+	assert.Equal(t, testServer.URL+"/v1/compile", api.route("compile"))
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "A", "contract A\n")
+	resp, err := negotiateCompile(context.Background(), req, api, serverAPI.compile)
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "A", resp.Objects[0].Objectname)
+
+	addInclude(req, "B", "contract B\n")
+	resp, err = api.compileJob(context.Background(), req)
+	require.NoError(t, err)
+	assert.Contains(t, resp.Rebuilt, "B")
+
+	link := new(v1.LinkResponse)
+	require.NoError(t, doJSON(context.Background(), "POST", api.route("link"), &v1.LinkRequest{Binary: "6060"}, link))
+	assert.Equal(t, "6060", link.Binary)
+
+	// failures are answered with the envelope
+	addInclude(req, "C", "contract C { boom }\n")
+	resp, err = api.compile(context.Background(), req)
+	assert.True(t, errors.Is(err, ErrCompileFailed), "%v", err)
+	require.NotNil(t, resp)
+	assert.Contains(t, resp.Error, "Error: boom")
+	resp, err = api.compileJob(context.Background(), req)
+	assert.True(t, errors.Is(err, ErrCompileFailed), "%v", err)
+	require.NotNil(t, resp)
+	assert.Contains(t, resp.Error, "Error: boom")
+
+	err = doJSON(context.Background(), "POST", api.route("unknown"), req, new(v1.CompileResponse))
+	assert.True(t, errors.Is(err, ErrNotFound), "%v", err)
+}
+
+func TestDiscoverLegacyAPI(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	// a server which predates /compilers answers it as a compile
+	testServer := httptest.NewServer(http.HandlerFunc(server.CompileHandler))
+	defer testServer.Close()
+
+	api := discoverAPI(context.Background(), testServer.URL)
+	assert.Empty(t, api.version)
+	assert.Equal(t, testServer.URL, api.route("compile"))
+	assert.Equal(t, testServer.URL+"/binaries", api.route("link"))
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "L", "contract L\n")
+	resp, err := api.compile(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"L"}, resp.Rebuilt)
+}
+
+func TestDiscoverAPIRetries(t *testing.T) {
+	// a server failing for the moment, then answering
+	failing := true
+	var requests int
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if failing {
+			writeError(w, http.StatusBadGateway, CodeInternal, "bad gateway")
+			return
+		}
+		writeJSON(w, http.StatusOK, &CompilersResponse{APIVersions: serverAPIVersions})
+	}))
+	defer testServer.Close()
+
+	assert.Empty(t, discoverAPI(context.Background(), testServer.URL).version)
+	failing = false
+	assert.Equal(t, v1.Version, discoverAPI(context.Background(), testServer.URL).version)
+	assert.Equal(t, v1.Version, discoverAPI(context.Background(), testServer.URL).version)
+	assert.Equal(t, 2, requests)
+
+	// a server without the endpoint is remembered as legacy
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer notFound.Close()
+	requests = 0
+	assert.Empty(t, discoverAPI(context.Background(), notFound.URL).version)
+	assert.Empty(t, discoverAPI(context.Background(), notFound.URL).version)
+	assert.Equal(t, 1, requests)
+}
+
+func TestDiscoverAPIConcurrently(t *testing.T) {
+	// a server slow to answer holds up only its own discovery
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		writeJSON(w, http.StatusOK, &CompilersResponse{})
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(CompilersHandler))
+	defer fast.Close()
+
+	go discoverAPI(context.Background(), slow.URL)
+	discovered := make(chan serverAPI)
+	go func() {
+		discovered <- discoverAPI(context.Background(), fast.URL)
+	}()
+	select {
+	case api := <-discovered:
+		assert.Equal(t, v1.Version, api.version)
+	case <-time.After(5 * time.Second):
+		t.Fatal("discovery held up by another server")
+	}
+}
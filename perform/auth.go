@@ -0,0 +1,181 @@
+package perform
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/monax/cli/log"
+)
+
+// Scopes a token may be granted
+const (
+	// compile contracts, including through the jobs and stream routes
+	ScopeCompile = "compile"
+	// link binaries
+	ScopeLink = "link"
+	// read server metrics; implies every other scope
+	ScopeAdmin = "admin"
+	// any token the server knows
+	scopeAny = ""
+)
+
+// Bearer tokens accepted by the server, read from a file holding one token
+// per line followed by a comma separated list of its scopes. Clients which
+// present a verified certificate may instead be granted scopes by the common
+// name of its subject, with a line starting "cn:".
+//
+//	# comment
+//	s3cr3t compile,link
+//	0p3r4t0r admin
+//	cn:build server compile
+type tokenStore struct {
+	path string
+	mu   sync.RWMutex
+	// scopes by sha256 of the token, so that lookups do not leak how much of
+	// a guessed token is right
+	scopes map[[sha256.Size]byte]map[string]bool
+	// scopes by client certificate common name
+	subjects map[string]map[string]bool
+}
+
+// prefix of the lines of a token file granting scopes to client certificates
+const subjectPrefix = "cn:"
+
+func loadTokens(path string) (*tokenStore, error) {
+	tokens := &tokenStore{path: path}
+	if err := tokens.reload(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Read the token file again, keeping the current tokens should it be invalid
+func (t *tokenStore) reload() error {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return fmt.Errorf("Could not read tokens: %s", err)
+	}
+	defer file.Close()
+
+	scopes := make(map[[sha256.Size]byte]map[string]bool)
+	subjects := make(map[string]map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: expected a token and its scopes", t.path, lineNo)
+		}
+		scopeList := fields[len(fields)-1]
+		ident := strings.TrimSpace(strings.TrimSuffix(line, scopeList))
+		if len(fields) > 2 && !strings.HasPrefix(ident, subjectPrefix) {
+			return fmt.Errorf("%s:%d: tokens may not contain spaces", t.path, lineNo)
+		}
+		granted := make(map[string]bool)
+		for _, scope := range strings.Split(scopeList, ",") {
+			switch scope {
+			case ScopeCompile, ScopeLink, ScopeAdmin:
+				granted[scope] = true
+			default:
+				return fmt.Errorf("%s:%d: unknown scope %q", t.path, lineNo, scope)
+			}
+		}
+		if strings.HasPrefix(ident, subjectPrefix) {
+			subjects[strings.TrimPrefix(ident, subjectPrefix)] = granted
+		} else {
+			scopes[sha256.Sum256([]byte(ident))] = granted
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Could not read tokens: %s", err)
+	}
+
+	t.mu.Lock()
+	t.scopes = scopes
+	t.subjects = subjects
+	t.mu.Unlock()
+	log.WithFields(log.Fields{
+		"tokens":   len(scopes),
+		"subjects": len(subjects),
+	}).Info("Loaded API tokens")
+	return nil
+}
+
+// whether token exists, and whether it is granted scope
+func (t *tokenStore) allows(token, scope string) (known, allowed bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	granted, known := t.scopes[sha256.Sum256([]byte(token))]
+	return known, known && (scope == scopeAny || granted[scope] || granted[ScopeAdmin])
+}
+
+// whether the common name of a client certificate is known, and whether it is
+// granted scope
+func (t *tokenStore) subjectAllows(commonName, scope string) (known, allowed bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	granted, known := t.subjects[commonName]
+	return known, known && (scope == scopeAny || granted[scope] || granted[ScopeAdmin])
+}
+
+// the verified certificate a client presented, nil if it did not
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// Require requests to handler to carry a bearer token granted scope, or a
+// client certificate whose subject is, when the server has tokens. Requests
+// without either are answered with 401 Unauthorized and those lacking the
+// scope with 403 Forbidden.
+func (s *Server) authorize(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.tokens == nil {
+			handler(w, r)
+			return
+		}
+		known, allowed := s.tokens.authorizeClient(clientCertificate(r), bearerToken(r), scope)
+		if !known {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="monax-compilers"`)
+			writeError(w, http.StatusUnauthorized, CodeUnauthorized, "missing or invalid API token")
+			return
+		}
+		if !allowed {
+			writeError(w, http.StatusForbidden, CodeForbidden, fmt.Sprintf("API token lacks the %s scope", scope))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// whether a client presenting cert and token, either of which may be missing,
+// is known, and whether it is granted scope
+func (t *tokenStore) authorizeClient(cert *x509.Certificate, token, scope string) (known, allowed bool) {
+	if cert != nil {
+		known, allowed = t.subjectAllows(cert.Subject.CommonName, scope)
+	}
+	if !known && token != "" {
+		known, allowed = t.allows(token, scope)
+	}
+	return known, allowed
+}
+
+// the bearer token of a request, if any
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
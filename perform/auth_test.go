@@ -0,0 +1,60 @@
+package perform
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorize(t *testing.T) {
+	server, closeServer := withTestServer()
+	defer closeServer()
+	dir, err := ioutil.TempDir("", "tokens")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := path.Join(dir, "tokens")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte(`# compile only
+compiler compile
+operator admin
+`), 0600))
+	server.tokens, err = loadTokens(tokenFile)
+	require.NoError(t, err)
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.authorize(ScopeCompile, ok))
+	mux.HandleFunc("/binaries", server.authorize(ScopeLink, ok))
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+	defer func() { Client.Token = "" }()
+
+	request := func(token, route string) error {
+		Client.Token = token
+		return doJSON(context.Background(), "GET", testServer.URL+route, nil, &struct{}{})
+	}
+	assert.True(t, errors.Is(request("", "/"), ErrUnauthorized))
+	assert.True(t, errors.Is(request("guess", "/"), ErrUnauthorized))
+	assert.NoError(t, request("compiler", "/"))
+	assert.True(t, errors.Is(request("compiler", "/binaries"), ErrForbidden))
+	assert.NoError(t, request("operator", "/binaries"))
+
+	// tokens are replaced on reload, but kept when the file is invalid
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("compiler compile,link\n"), 0600))
+	require.NoError(t, server.tokens.reload())
+	assert.NoError(t, request("compiler", "/binaries"))
+	assert.True(t, errors.Is(request("operator", "/"), ErrUnauthorized))
+
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("compiler everything\n"), 0600))
+	assert.Error(t, server.tokens.reload())
+	assert.NoError(t, request("compiler", "/binaries"))
+}
@@ -0,0 +1,366 @@
+package perform
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/util"
+
+	"github.com/monax/cli/log"
+)
+
+// Cache bundles are gzipped tarballs of cache entries used to carry verified
+// compile results into environments which cannot reach a compile server. A
+// bundle starts with manifest.json describing every entry, followed by the
+// script of each include at <lang>/<hash>/script and its objects under
+// <lang>/<hash>/<settings>/, each <object>.json with its hex encoded sha256
+// in <object>.json.sha256. Bundles of format 1 kept the objects of an
+// include under <lang>/<hash>/, whatever its settings.
+const (
+	bundleFormat   = 2
+	bundleManifest = "manifest.json"
+	checksumExt    = ".sha256"
+)
+
+var hashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type BundleManifest struct {
+	Format  int           `json:"format"`
+	Created time.Time     `json:"created"`
+	Entries []BundleEntry `json:"entries"`
+}
+
+// A cache entry in a bundle along with what it was compiled with
+type BundleEntry struct {
+	Language        string   `json:"language"`
+	Hash            string   `json:"hash"`
+	CompilerVersion string   `json:"compilerVersion"`
+	Optimize        bool     `json:"optimize"`
+	Libraries       string   `json:"libraries"`
+	ObjectNames     []string `json:"objectNames"`
+}
+
+// Selects entries by source hash. The zero value selects every entry.
+type BundleFilter struct {
+	Hashes []string
+}
+
+func (f BundleFilter) match(hash string) bool {
+	if len(f.Hashes) == 0 {
+		return true
+	}
+	for _, h := range f.Hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Build a filter selecting the includes of every source file listed in a
+// project manifest. The manifest lists one file per line relative to the
+// manifest itself, blank lines and lines starting with # are ignored.
+func ManifestFilter(manifest string) (BundleFilter, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return BundleFilter{}, err
+	}
+	defer f.Close()
+
+	var filter BundleFilter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		req, err := CreateRequest(filepath.Join(filepath.Dir(manifest), line), "", false)
+		if err != nil {
+			return BundleFilter{}, err
+		}
+		for name := range req.Includes {
+			filter.Hashes = append(filter.Hashes, strings.TrimSuffix(name, "."+req.Language))
+		}
+	}
+	return filter, scanner.Err()
+}
+
+// Write the cache entries selected by filter to a bundle at file. Entries
+// which fail verification are left out.
+func ExportCache(file string, filter BundleFilter) (*BundleManifest, error) {
+	manifest := &BundleManifest{
+		Format:  bundleFormat,
+		Created: time.Now().UTC(),
+		Entries: []BundleEntry{},
+	}
+	files := make(map[string][]byte)
+
+	var langs []string
+	for lang := range definitions.Languages {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		dirs, err := ioutil.ReadDir(definitions.Languages[lang].CacheDir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			hash := dir.Name()
+			if !dir.IsDir() || !hashPattern.MatchString(hash) || !filter.match(hash) {
+				continue
+			}
+			settingsDirs, err := ioutil.ReadDir(path.Join(definitions.Languages[lang].CacheDir, hash))
+			if err != nil {
+				return nil, err
+			}
+			for _, settingsDir := range settingsDirs {
+				if !settingsDir.IsDir() || !settingsPattern.MatchString(settingsDir.Name()) {
+					continue
+				}
+				entry, entryFiles, err := exportEntry(lang, hash, settingsDir.Name())
+				if err != nil {
+					log.WithField("entry", path.Join(hash, settingsDir.Name())).Warnf("Skipping cache entry: %s", err)
+					continue
+				}
+				manifest.Entries = append(manifest.Entries, *entry)
+				for name, contents := range entryFiles {
+					files[path.Join(lang, hash, name)] = contents
+				}
+			}
+		}
+	}
+
+	if err := writeBundle(file, manifest, files); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// collect the files of a cache entry, relative to the directory of its
+// include, verifying its objects on the way
+func exportEntry(lang, hash, settings string) (*BundleEntry, map[string][]byte, error) {
+	dir := path.Join(definitions.Languages[lang].CacheDir, hash, settings)
+	meta, err := readCacheMeta(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make(map[string][]byte)
+	for _, object := range meta.ObjectNames {
+		entry := path.Join(dir, object+".json")
+		if _, err = readCacheEntry(lang, entry); err != nil {
+			return nil, nil, err
+		}
+		objectJ, _, err := readCacheObject(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		sum := sha256.Sum256(objectJ)
+		files[path.Join(settings, object+".json")] = objectJ
+		files[path.Join(settings, object+".json"+checksumExt)] = []byte(hex.EncodeToString(sum[:]))
+	}
+	if script, ok := loadScript(lang, hash+"."+lang); ok {
+		files[scriptFile] = script
+	}
+	return &BundleEntry{
+		Language:        lang,
+		Hash:            hash,
+		CompilerVersion: meta.CompilerVersion,
+		Optimize:        meta.Optimize,
+		Libraries:       meta.Libraries,
+		ObjectNames:     meta.ObjectNames,
+	}, files, nil
+}
+
+func writeBundle(file string, manifest *BundleManifest, files map[string][]byte) error {
+	manifestJ, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	write := func(name string, contents []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(contents)),
+			ModTime: manifest.Created,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(contents)
+		return err
+	}
+	if err = write(bundleManifest, manifestJ); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = write(name, files[name]); err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(file, buf.Bytes(), 0644)
+}
+
+// Install the entries of a bundle selected by filter into the local cache so
+// that they are served as cache hits. Entries are verified against their
+// checksums before being installed; the manifest returned lists only the
+// entries which were installed.
+func ImportCache(file string, filter BundleFilter) (*BundleManifest, error) {
+	manifest, files, err := readBundle(file)
+	if err != nil {
+		return nil, err
+	}
+	imported := &BundleManifest{
+		Format:  manifest.Format,
+		Created: manifest.Created,
+		Entries: []BundleEntry{},
+	}
+	for _, entry := range manifest.Entries {
+		if !filter.match(entry.Hash) {
+			continue
+		}
+		if err = importEntry(manifest.Format, entry, files); err != nil {
+			log.WithField("entry", entry.Hash).Warnf("Skipping bundle entry: %s", err)
+			continue
+		}
+		imported.Entries = append(imported.Entries, entry)
+	}
+	return imported, nil
+}
+
+func readBundle(file string) (*BundleManifest, map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if files[hdr.Name], err = ioutil.ReadAll(tr); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	manifestJ, ok := files[bundleManifest]
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not a cache bundle: no %s", file, bundleManifest)
+	}
+	manifest := new(BundleManifest)
+	if err = json.Unmarshal(manifestJ, manifest); err != nil {
+		return nil, nil, err
+	}
+	if manifest.Format < 1 || manifest.Format > bundleFormat {
+		return nil, nil, fmt.Errorf("unsupported cache bundle format %d", manifest.Format)
+	}
+	return manifest, files, nil
+}
+
+// verify a single bundle entry and write it into the cache
+func importEntry(format int, entry BundleEntry, files map[string][]byte) error {
+	if _, ok := definitions.Languages[entry.Language]; !ok {
+		return fmt.Errorf("unknown language %s", entry.Language)
+	}
+	if !hashPattern.MatchString(entry.Hash) {
+		return fmt.Errorf("invalid hash %q", entry.Hash)
+	}
+	prefix := path.Join(entry.Language, entry.Hash)
+	settings := compileSettings{Optimize: entry.Optimize, Libraries: entry.Libraries}
+	objectPrefix := path.Join(prefix, settings.key())
+	if format == 1 {
+		objectPrefix = prefix
+	}
+	objects := make(map[string][]byte)
+	for _, object := range entry.ObjectNames {
+		if object == "" || strings.ContainsAny(object, `/\`) || strings.HasPrefix(object, ".") {
+			return fmt.Errorf("invalid object name %q", object)
+		}
+		objectJ, ok := files[path.Join(objectPrefix, object+".json")]
+		if !ok {
+			return fmt.Errorf("object %s is missing", object)
+		}
+		sum := sha256.Sum256(objectJ)
+		if strings.TrimSpace(string(files[path.Join(objectPrefix, object+".json"+checksumExt)])) != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("object %s: checksum mismatch", object)
+		}
+		if err := json.Unmarshal(objectJ, new(Response)); err != nil {
+			return fmt.Errorf("object %s: %v", object, err)
+		}
+		objects[object] = objectJ
+	}
+	script, scriptOK := files[path.Join(prefix, scriptFile)]
+	if scriptOK && !scriptMatches(entry.Language, entry.Hash+"."+entry.Language, script) {
+		return fmt.Errorf("script does not match its hash")
+	}
+
+	name := entry.Hash + "." + entry.Language
+	dir := cacheObjectDir(entry.Language, name, settings)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if scriptOK {
+		if err := util.WriteFileAtomic(path.Join(cacheEntryDir(entry.Language, name), scriptFile), script, 0644); err != nil {
+			return err
+		}
+	}
+	for object, objectJ := range objects {
+		if err := writeCacheObject(path.Join(dir, object+".json"), objectJ); err != nil {
+			return err
+		}
+	}
+	return writeCacheMeta(dir, &cacheMeta{
+		Language:        entry.Language,
+		CompilerVersion: entry.CompilerVersion,
+		Optimize:        entry.Optimize,
+		Libraries:       entry.Libraries,
+		ObjectNames:     entry.ObjectNames,
+	})
+}
@@ -0,0 +1,77 @@
+package perform
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	dir, cleanup := withTestCache(t)
+	defer cleanup()
+
+	script := []byte("contract C {}")
+	sum := sha256.Sum256(script)
+	hash := hex.EncodeToString(sum[:])
+	req := definitions.Request{
+		Language: testLang,
+		Optimize: true,
+		Includes: map[string]*definitions.IncludedFiles{
+			hash + "." + testLang: {ObjectNames: []string{"C"}, Script: script},
+		},
+	}
+	require.NoError(t, resolveScripts(context.Background(), &req))
+	resp := Response{Objects: []ResponseItem{{Objectname: "C", Bytecode: "6060", ABI: "[]"}}}
+	require.NoError(t, resp.cacheNewResponse(req, "0.4.4"))
+
+	bundle := path.Join(dir, "bundle.tar.gz")
+	filter := BundleFilter{Hashes: []string{hash}}
+	exported, err := ExportCache(bundle, filter)
+	require.NoError(t, err)
+	require.Len(t, exported.Entries, 1)
+	assert.Equal(t, "0.4.4", exported.Entries[0].CompilerVersion)
+	assert.True(t, exported.Entries[0].Optimize)
+
+	require.NoError(t, os.RemoveAll(path.Join(dir, hash)))
+	assert.False(t, CheckCached(&req))
+
+	imported, err := ImportCache(bundle, filter)
+	require.NoError(t, err)
+	assert.Equal(t, exported.Entries, imported.Entries)
+	cached, err := CachedResponse(&req)
+	require.NoError(t, err)
+	assert.Equal(t, resp.Objects, cached.Objects)
+	assert.True(t, hasScript(testLang, hash+"."+testLang))
+}
+
+func TestBundleImportRejectsTamperedEntries(t *testing.T) {
+	dir, cleanup := withTestCache(t)
+	defer cleanup()
+
+	hash := hex.EncodeToString(make([]byte, sha256.Size))
+	settings := compileSettings{}.key()
+	manifest := &BundleManifest{
+		Format: bundleFormat,
+		Entries: []BundleEntry{
+			{Language: testLang, Hash: hash, ObjectNames: []string{"C"}},
+		},
+	}
+	bundle := path.Join(dir, "bundle.tar.gz")
+	require.NoError(t, writeBundle(bundle, manifest, map[string][]byte{
+		path.Join(testLang, hash, settings, "C.json"):             []byte(`{"objects":[]}`),
+		path.Join(testLang, hash, settings, "C.json"+checksumExt): []byte("not the checksum"),
+	}))
+
+	imported, err := ImportCache(bundle, BundleFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, imported.Entries)
+	_, err = os.Stat(path.Join(dir, hash))
+	assert.True(t, os.IsNotExist(err))
+}
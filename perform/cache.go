@@ -1,57 +1,118 @@
 package perform
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/util"
+
+	"github.com/monax/cli/log"
+)
+
+// Cache entries live at <CacheDir>/<hash>/<settings>/<object>.json, where
+// <settings> names the settings the include was compiled with, each holding
+// the object together with the hex encoded sha256 of it (see storedObject).
+// Entries which fail verification are moved into <CacheDir>/quarantine. The server also keeps the script of each include at
+// <CacheDir>/<hash>/script so that clients need not upload unchanged files
+// again, and the compiler and settings of each entry at
+// <CacheDir>/<hash>/<settings>/metadata.
+const (
+	quarantineDir = "quarantine"
+	scriptFile    = "script"
+	metaFile      = "metadata"
 )
 
+// Compiler and settings a cache entry was produced with
+type cacheMeta struct {
+	Language        string   `json:"language"`
+	CompilerVersion string   `json:"compilerVersion"`
+	Optimize        bool     `json:"optimize"`
+	Libraries       string   `json:"libraries"`
+	ObjectNames     []string `json:"objectNames"`
+}
+
+var errCorruptCache = errors.New("corrupt cache entry")
+
+// Settings of a request which change what its includes compile to. Objects
+// are cached apart by them so that they are only served to requests compiling
+// the same way.
+type compileSettings struct {
+	Optimize  bool
+	Libraries string
+}
+
+func requestSettings(req *definitions.Request) compileSettings {
+	return compileSettings{Optimize: req.Optimize, Libraries: req.Libraries}
+}
+
+// name of the directory of the objects compiled with the settings, a prefix
+// of the sha256 of the settings
+func (s compileSettings) key() string {
+	settingsJ, _ := json.Marshal([]interface{}{s.Optimize, s.Libraries})
+	sum := sha256.Sum256(settingsJ)
+	return hex.EncodeToString(sum[:8])
+}
+
+var settingsPattern = regexp.MustCompile("^[0-9a-f]{16}$")
+
+// directory of an include (named <hash>.<lang>), holding its script
+func cacheEntryDir(lang, name string) string {
+	return path.Join(definitions.Languages[lang].CacheDir, strings.TrimSuffix(name, "."+lang))
+}
+
+// directory holding the objects an include compiled to with the settings
+func cacheObjectDir(lang, name string, settings compileSettings) string {
+	return path.Join(cacheEntryDir(lang, name), settings.key())
+}
+
 // check/cache all includes, hash the code, return whether or not there was a full cache hit
-func CheckCached(includes map[string]*definitions.IncludedFiles, lang string) bool {
-	cached := true
-	for name, metadata := range includes {
-		hashPath := path.Join(definitions.Languages[lang].CacheDir, name)
-		if _, scriptErr := os.Stat(hashPath); os.IsNotExist(scriptErr) {
-			cached = false
-			break
-		}
-		for _, object := range metadata.ObjectNames {
-			objectFile := path.Join(hashPath, object+".json")
-			if _, objErr := os.Stat(objectFile); objErr != nil {
-				cached = false
-				break
-			}
-		}
-		if cached == false {
-			break
+func CheckCached(req *definitions.Request) bool {
+	for name, metadata := range req.Includes {
+		if !entryCached(req.Language, name, requestSettings(req), metadata.ObjectNames) {
+			return false
 		}
 	}
+	return true
+}
 
-	return cached
+// whether every object of a single include is cached
+func entryCached(lang, name string, settings compileSettings, objects []string) bool {
+	dir := cacheObjectDir(lang, name, settings)
+	if _, err := os.Stat(dir); err != nil {
+		return false
+	}
+	for _, object := range objects {
+		if _, err := os.Stat(path.Join(dir, object+".json")); err != nil {
+			return false
+		}
+	}
+	return true
 }
 
-// return cached byte code as a response
-func CachedResponse(includes map[string]*definitions.IncludedFiles, lang string) (*Response, error) {
+// return cached byte code as a response. Should any entry fail verification it
+// is quarantined and an error wrapping errCorruptCache is returned so that the
+// caller can recompile.
+func CachedResponse(req *definitions.Request) (*Response, error) {
 
 	var resp *Response
 	var respItemArray []ResponseItem
-	for name, metadata := range includes {
-		dir := path.Join(definitions.Languages[lang].CacheDir, name)
-		for _, object := range metadata.ObjectNames {
-			jsonBytes, err := ioutil.ReadFile(path.Join(dir, object+".json"))
-			if err != nil {
-				return nil, err
-			}
-			respItem := &ResponseItem{}
-			err = json.Unmarshal(jsonBytes, respItem)
-			if err != nil {
-				return nil, err
-			}
-			respItemArray = append(respItemArray, *respItem)
+	for name, metadata := range req.Includes {
+		objects, err := cachedObjects(req.Language, name, requestSettings(req), metadata.ObjectNames)
+		if err != nil {
+			return nil, err
 		}
+		respItemArray = append(respItemArray, objects...)
 	}
 	resp = &Response{
 		Objects: respItemArray,
@@ -62,11 +123,161 @@ func CachedResponse(includes map[string]*definitions.IncludedFiles, lang string)
 	return resp, nil
 }
 
-// cache ABI and Binary to
+// read the cached objects of a single include
+func cachedObjects(lang, name string, settings compileSettings, objects []string) ([]ResponseItem, error) {
+	var respItemArray []ResponseItem
+	dir := cacheObjectDir(lang, name, settings)
+	for _, object := range objects {
+		cached, err := readCacheEntry(lang, path.Join(dir, object+".json"))
+		if err != nil {
+			return nil, err
+		}
+		respItemArray = append(respItemArray, cached.Objects...)
+	}
+	return respItemArray, nil
+}
+
+// cache ABI and Binary to cacheLocation
 func CacheResult(object ResponseItem, cacheLocation, warning, version, errorString string) error {
-	os.Chdir(cacheLocation)
-	fullResponse := Response{[]ResponseItem{object}, warning, version, errorString}
+	fullResponse := Response{
+		Objects: []ResponseItem{object},
+		Warning: warning,
+		Version: version,
+		Error:   errorString,
+	}
 	cachedObject, err := json.Marshal(fullResponse)
-	ioutil.WriteFile(object.Objectname+".json", []byte(cachedObject), 0644)
-	return err
+	if err != nil {
+		return err
+	}
+	return writeCacheObject(path.Join(cacheLocation, object.Objectname+".json"), cachedObject)
+}
+
+// A cache entry as stored, the object with its checksum so that the two are
+// written, and renamed into place, as one file. Readers, in this process or
+// another such as cache import, never see an object with another's checksum.
+type storedObject struct {
+	SHA256 string          `json:"sha256"`
+	Object json.RawMessage `json:"object"`
+}
+
+// write a cache object with its checksum to a temporary file renamed into
+// place so that readers never observe a partial write
+func writeCacheObject(entry string, data []byte) error {
+	// the object is stored compacted, so it is that which is summed
+	var object bytes.Buffer
+	if err := json.Compact(&object, data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(object.Bytes())
+	var stored bytes.Buffer
+	enc := json.NewEncoder(&stored)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(storedObject{SHA256: hex.EncodeToString(sum[:]), Object: object.Bytes()}); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(entry, stored.Bytes(), 0644)
+}
+
+// read a cache object and whether it matches its checksum
+func readCacheObject(entry string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(entry)
+	if err != nil {
+		return nil, false, err
+	}
+	stored := new(storedObject)
+	if err = json.Unmarshal(data, stored); err != nil {
+		return nil, false, nil
+	}
+	sum := sha256.Sum256(stored.Object)
+	return stored.Object, stored.SHA256 == hex.EncodeToString(sum[:]), nil
+}
+
+// read and verify a single cache entry, quarantining it if it is corrupt
+func readCacheEntry(lang, entry string) (*Response, error) {
+	jsonBytes, ok, err := readCacheObject(entry)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		quarantineEntry(lang, entry)
+		return nil, fmt.Errorf("%s: checksum mismatch: %w", entry, errCorruptCache)
+	}
+	resp := &Response{}
+	if err = json.Unmarshal(jsonBytes, resp); err != nil {
+		quarantineEntry(lang, entry)
+		return nil, fmt.Errorf("%s: %v: %w", entry, err, errCorruptCache)
+	}
+	return resp, nil
+}
+
+// move a corrupt entry out of the way so it is recompiled
+func quarantineEntry(lang, entry string) {
+	cacheDir := definitions.Languages[lang].CacheDir
+	dir := path.Join(cacheDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Errorln("failed to create quarantine directory", err)
+		return
+	}
+	// <hash>-<settings>-<object>.json.<time>
+	name := fmt.Sprintf("%s.%d", strings.Replace(strings.TrimPrefix(entry, cacheDir+"/"), "/", "-", -1),
+		time.Now().UnixNano())
+	log.WithFields(log.Fields{
+		"entry": entry,
+		"to":    path.Join(dir, name),
+	}).Warn("Quarantining corrupt cache entry")
+	if err := os.Rename(entry, path.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+		log.Errorln("failed to quarantine cache entry", err)
+	}
+}
+
+// keep the script of an include so it can be left out of later requests
+func storeScript(lang, name string, script []byte) error {
+	if !scriptMatches(lang, name, script) {
+		return fmt.Errorf("script does not match its name %s", name)
+	}
+	dir := cacheEntryDir(lang, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(path.Join(dir, scriptFile), script, 0644)
+}
+
+// load a script stored by storeScript
+func loadScript(lang, name string) ([]byte, bool) {
+	script, err := ioutil.ReadFile(path.Join(cacheEntryDir(lang, name), scriptFile))
+	if err != nil || !scriptMatches(lang, name, script) {
+		return nil, false
+	}
+	return script, true
+}
+
+func hasScript(lang, name string) bool {
+	_, ok := loadScript(lang, name)
+	return ok
+}
+
+// includes are named after the hash of their script
+func scriptMatches(lang, name string, script []byte) bool {
+	sum := sha256.Sum256(script)
+	return hex.EncodeToString(sum[:])+"."+lang == name
+}
+
+func writeCacheMeta(dir string, meta *cacheMeta) error {
+	metaJ, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(path.Join(dir, metaFile), metaJ, 0644)
+}
+
+func readCacheMeta(dir string) (*cacheMeta, error) {
+	metaJ, err := ioutil.ReadFile(path.Join(dir, metaFile))
+	if err != nil {
+		return nil, err
+	}
+	meta := new(cacheMeta)
+	if err = json.Unmarshal(metaJ, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
 }
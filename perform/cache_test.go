@@ -0,0 +1,130 @@
+package perform
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testLang = "testlang"
+
+func withTestCache(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "compilers-cache")
+	require.NoError(t, err)
+	definitions.Languages[testLang] = definitions.LangConfig{CacheDir: dir}
+	return dir, func() {
+		delete(definitions.Languages, testLang)
+		os.RemoveAll(dir)
+	}
+}
+
+func testRequest() definitions.Request {
+	return definitions.Request{
+		Language: testLang,
+		Includes: map[string]*definitions.IncludedFiles{
+			"abcdef." + testLang: {
+				ObjectNames: []string{"C"},
+				Script:      []byte("contract C {}"),
+			},
+		},
+	}
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	_, cleanup := withTestCache(t)
+	defer cleanup()
+
+	req := testRequest()
+	assert.False(t, CheckCached(&req))
+
+	resp := Response{Objects: []ResponseItem{{Objectname: "C", Bytecode: "6060", ABI: "[]"}}}
+	require.NoError(t, resp.CacheNewResponse(req))
+	assert.True(t, CheckCached(&req))
+
+	cached, err := CachedResponse(&req)
+	require.NoError(t, err)
+	assert.Equal(t, resp.Objects, cached.Objects)
+}
+
+func TestCorruptCacheEntryIsQuarantined(t *testing.T) {
+	dir, cleanup := withTestCache(t)
+	defer cleanup()
+
+	req := testRequest()
+	resp := Response{Objects: []ResponseItem{{Objectname: "C", Bytecode: "6060", ABI: "[]"}}}
+	require.NoError(t, resp.CacheNewResponse(req))
+
+	// simulate a truncated write
+	entry := path.Join(dir, "abcdef", requestSettings(&req).key(), "C.json")
+	require.NoError(t, ioutil.WriteFile(entry, []byte(`{"objects":[{"obj`), 0644))
+
+	_, err := CachedResponse(&req)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, errCorruptCache))
+	assert.False(t, CheckCached(&req))
+
+	quarantined, err := ioutil.ReadDir(path.Join(dir, quarantineDir))
+	require.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+}
+
+func TestCacheEntryHoldsChecksum(t *testing.T) {
+	dir, cleanup := withTestCache(t)
+	defer cleanup()
+
+	req := testRequest()
+	resp := Response{Objects: []ResponseItem{{Objectname: "C", Bytecode: "6060", ABI: "[]"}}}
+	require.NoError(t, resp.CacheNewResponse(req))
+	entry := path.Join(dir, "abcdef", requestSettings(&req).key(), "C.json")
+	entries, err := ioutil.ReadDir(path.Dir(entry))
+	require.NoError(t, err)
+	for _, info := range entries {
+		assert.False(t, strings.HasSuffix(info.Name(), ".sha256"), "checksum kept apart in %s", info.Name())
+	}
+
+	// an object changed without its checksum is corrupt
+	stored, err := ioutil.ReadFile(entry)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(entry, bytes.Replace(stored, []byte("6060"), []byte("6061"), 1), 0644))
+	_, err = CachedResponse(&req)
+	assert.True(t, errors.Is(err, errCorruptCache))
+}
+
+func TestCacheRewriteIsNotQuarantined(t *testing.T) {
+	dir, cleanup := withTestCache(t)
+	defer cleanup()
+
+	req := testRequest()
+	entryDir := path.Join(dir, "abcdef", requestSettings(&req).key())
+	require.NoError(t, os.MkdirAll(entryDir, 0700))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			object := ResponseItem{Objectname: "C", Bytecode: strconv.Itoa(i), ABI: "[]"}
+			assert.NoError(t, CacheResult(object, entryDir, "", "", ""))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			_, err := os.Stat(path.Join(dir, quarantineDir))
+			assert.True(t, os.IsNotExist(err), "valid entry quarantined")
+			return
+		default:
+		}
+		if CheckCached(&req) {
+			_, err := CachedResponse(&req)
+			require.NoError(t, err)
+		}
+	}
+}
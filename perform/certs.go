@@ -0,0 +1,149 @@
+package perform
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/monax/cli/log"
+)
+
+const (
+	// certificates expiring sooner than this are warned about
+	certExpiryWarning = 30 * 24 * time.Hour
+	// how often to check whether the certificate is about to expire
+	certExpiryCheck = 24 * time.Hour
+	// how long to wait for writes to settle before reloading changed files,
+	// as the certificate and key are rarely replaced at once
+	certReloadDelay = 500 * time.Millisecond
+)
+
+// TLS key pair of the server, re-read from its files when they change or the
+// server is sent SIGHUP so that certificates can be rotated without dropping
+// in-flight compiles
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func loadCertificate(certFile, keyFile string) (*certReloader, error) {
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := certs.reload(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// Read the key pair again, keeping the current one should the new one be
+// invalid, expired or not match its key
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Could not load TLS certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Could not load TLS certificate: %s", err)
+	}
+	if now := time.Now(); now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		return fmt.Errorf("TLS certificate %s is only valid from %s to %s",
+			c.certFile, leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	log.WithFields(log.Fields{
+		"file":    c.certFile,
+		"subject": leaf.Subject.CommonName,
+		"expires": leaf.NotAfter.Format(time.RFC3339),
+	}).Info("Loaded TLS certificate")
+	c.checkExpiry()
+	return nil
+}
+
+// the tls.Config GetCertificate callback
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// warn should the certificate be about to expire
+func (c *certReloader) checkExpiry() {
+	c.mu.RLock()
+	expires := c.cert.Leaf.NotAfter
+	c.mu.RUnlock()
+	if left := time.Until(expires); left < certExpiryWarning {
+		log.WithFields(log.Fields{
+			"file":    c.certFile,
+			"expires": expires.Format(time.RFC3339),
+		}).Warnf("TLS certificate expires in %s", left.Truncate(time.Minute))
+	}
+}
+
+// Reload the key pair whenever its files change, and check daily that it is
+// not about to expire, until stopped is closed. The directories holding the
+// files are watched rather than the files, which are often replaced rather
+// than written to.
+func (c *certReloader) watch(stopped <-chan struct{}) {
+	expiry := time.NewTicker(certExpiryCheck)
+	defer expiry.Stop()
+
+	var events chan fsnotify.Event
+	var errs chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		for _, dir := range []string{filepath.Dir(c.certFile), filepath.Dir(c.keyFile)} {
+			if err = watcher.Add(dir); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("Could not watch TLS certificate, reload it with SIGHUP: %s", err)
+	} else {
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	var settle <-chan time.Time
+	for {
+		select {
+		case event := <-events:
+			if event.Op == fsnotify.Chmod || !c.concerns(event.Name) {
+				continue
+			}
+			log.WithField("file", event.Name).Debug("TLS certificate directory changed")
+			settle = time.After(certReloadDelay)
+		case err := <-errs:
+			log.Errorf("Error watching TLS certificate: %s", err)
+		case <-settle:
+			settle = nil
+			if err := c.reload(); err != nil {
+				log.Errorf("Keeping the current TLS certificate: %s", err)
+			}
+		case <-expiry.C:
+			c.checkExpiry()
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// whether a change to the file name may have changed the key pair. Files
+// mounted from Kubernetes secrets are symlinks into a "..data" directory
+// which is swapped for a new one when the secret changes.
+func (c *certReloader) concerns(name string) bool {
+	name = filepath.Clean(name)
+	return name == filepath.Clean(c.certFile) || name == filepath.Clean(c.keyFile) ||
+		strings.HasPrefix(filepath.Base(name), "..")
+}
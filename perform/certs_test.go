@@ -0,0 +1,57 @@
+package perform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files, err := SelfSigned(dir, []string{"localhost"})
+	require.NoError(t, err)
+
+	certs, err := loadCertificate(files.CertFile, files.KeyFile)
+	require.NoError(t, err)
+	first, err := certs.getCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"localhost"}, first.Leaf.DNSNames)
+
+	// a pair whose key does not match is rejected, keeping the current one
+	otherKey := filepath.Join(dir, "other.key")
+	_, _, err = createCertificate(filepath.Join(dir, "other.pem"), otherKey, nil, nil, nil)
+	require.NoError(t, err)
+	key, err := ioutil.ReadFile(files.KeyFile)
+	require.NoError(t, err)
+	other, err := ioutil.ReadFile(otherKey)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(files.KeyFile, other, 0600))
+	assert.Error(t, certs.reload())
+	cert, _ := certs.getCertificate(nil)
+	assert.Equal(t, first, cert)
+	require.NoError(t, ioutil.WriteFile(files.KeyFile, key, 0600))
+
+	// files which change are picked up without a reload
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go certs.watch(stopped)
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+	_, err = SelfSigned(dir, []string{"dev.local"})
+	require.NoError(t, err)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cert, _ = certs.getCertificate(nil); cert != first {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"dev.local"}, cert.Leaf.DNSNames)
+}
@@ -2,87 +2,445 @@ package perform
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/monax/cli/log"
 	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/definitions/v1"
 )
 
-// send an http request and wait for the response
-func requestResponse(req *definitions.Request, URL string) (*Response, error) {
-	// make request
-	reqJ, err := json.Marshal(req)
+// Settings applied to every request sent to a compile server
+type ClientConfig struct {
+	// Bearer token sent to servers which require authentication
+	Token string
+	// Certificate and key presented to servers which verify clients
+	CertFile string
+	KeyFile  string
+	// CA certificates to trust servers signed by instead of the system roots
+	CAFile string
+	// Fingerprint of the CA to trust servers signed by instead, which they
+	// must send along with their certificate as those made by SelfSigned do
+	CAFingerprint string
+	// Unix domain socket to connect to instead of the host of request URLs,
+	// optionally prefixed with UnixPrefix
+	Socket string
+}
+
+// Settings of the client, set these before making requests
+var Client ClientConfig
+
+var (
+	transportLock sync.Mutex
+	// TLS transport and the settings it was built for, so that connections
+	// are reused between requests
+	transportConfig ClientConfig
+	transport       *http.Transport
+)
+
+// http client for the TLS and socket settings of c
+func (c ClientConfig) httpClient() (*http.Client, error) {
+	transportSettings := ClientConfig{
+		CertFile:      c.CertFile,
+		KeyFile:       c.KeyFile,
+		CAFile:        c.CAFile,
+		CAFingerprint: c.CAFingerprint,
+		Socket:        c.Socket,
+	}
+	if transportSettings == (ClientConfig{}) {
+		return &http.Client{}, nil
+	}
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	if transport == nil || transportConfig != transportSettings {
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		pin, err := c.pinnedCA()
+		if err != nil {
+			return nil, err
+		}
+		if transport != nil {
+			transport.CloseIdleConnections()
+		}
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		dialer := &net.Dialer{}
+		dial := dialer.DialContext
+		if c.Socket != "" {
+			socket := strings.TrimPrefix(c.Socket, UnixPrefix)
+			dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			}
+			transport.DialContext = dial
+		}
+		if pin != nil {
+			transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return pinnedClient(ctx, conn, tlsConfig, addr, pin)
+			}
+		}
+		transportConfig = transportSettings
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// TLS settings presenting the client certificate of c and trusting its CA
+// file. A pinned CA is left to the dialer, see pinnedCA.
+func (c ClientConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		roots, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load CA: %s", err)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	return tlsConfig, nil
+}
+
+// sha256 digest of the CA c pins, nil if it pins none. Connections to
+// servers trusted by it are verified once the handshake is done, by
+// pinnedClient, rather than by a tls.Config callback which copies of the
+// settings could leave out.
+func (c ClientConfig) pinnedCA() ([]byte, error) {
+	if c.CAFingerprint == "" {
+		return nil, nil
+	}
+	return parseFingerprint(c.CAFingerprint)
+}
+
+// read a file of PEM encoded certificates into a pool
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pemCerts, err := ioutil.ReadFile(file)
 	if err != nil {
-		log.Errorln("failed to marshal req obj", err)
 		return nil, err
 	}
-	httpreq, err := http.NewRequest("POST", URL, bytes.NewBuffer(reqJ))
-	if err != nil {
-		log.Errorln("failed to compose request:", err)
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// send an http request and wait for the response. A failed compile is
+// returned as both a Response carrying the compiler's output and an error
+// which is ErrCompileFailed.
+func requestResponse(ctx context.Context, req *definitions.Request, URL string) (*Response, error) {
+	respJ := new(Response)
+	if err := doJSON(ctx, "POST", URL, req, respJ); err != nil {
+		if errors.Is(err, ErrCompileFailed) {
+			return compilerResponse("", "", "", "", "", err), err
+		}
 		return nil, err
 	}
-	httpreq.Header.Set("Content-Type", "application/json")
+	return respJ, legacyError(respJ.Error)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(httpreq)
-	if err != nil {
-		log.Errorln("failed to send HTTP request", err)
+// send a compile request to a v1 compile route and wait for the response. A
+// failed compile is returned as in requestResponse.
+func requestV1Response(ctx context.Context, req *definitions.Request, URL string) (*Response, error) {
+	respJ := new(v1.CompileResponse)
+	if err := doJSON(ctx, "POST", URL, requestToV1(req), respJ); err != nil {
+		if errors.Is(err, ErrCompileFailed) {
+			return compilerResponse("", "", "", "", "", err), err
+		}
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return responseFromV1(respJ), nil
+}
 
-	if resp.StatusCode > 300 {
-		return nil, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+// send an http request and wait for the response
+func requestBinaryResponse(ctx context.Context, req *definitions.BinaryRequest, URL string) (*BinaryResponse, error) {
+	respJ := new(BinaryResponse)
+	if err := doJSON(ctx, "POST", URL, req, respJ); err != nil {
+		return nil, err
 	}
+	return respJ, legacyError(respJ.Error)
+}
 
-	respJ := new(Response)
-	// read in response body
-	body, err := ioutil.ReadAll(resp.Body)
-	err = json.Unmarshal(body, respJ)
-	if err != nil {
-		log.Errorln("failed to unmarshal", err)
+// ask the server which includes of req it still needs before uploading them
+func requestNegotiation(ctx context.Context, req *definitions.NegotiationRequest, URL string) (*NegotiationResponse, error) {
+	respJ := new(NegotiationResponse)
+	if err := doJSON(ctx, "POST", URL, req, respJ); err != nil {
 		return nil, err
 	}
 	return respJ, nil
 }
 
-// send an http request and wait for the response
-func requestBinaryResponse(req *definitions.BinaryRequest, URL string) (*BinaryResponse, error) {
-	// make request
-	reqJ, err := json.Marshal(req)
+// How often RequestCompileJob polls the server for the status of its job
+var JobPollInterval = time.Second
+
+// submit req to the jobs API of the server and poll the job until it
+// finishes. The job is cancelled should ctx be done first.
+func requestJobResponse(ctx context.Context, req *definitions.Request, api serverAPI) (*Response, error) {
+	job, err := doJob(ctx, "POST", api, api.route("jobs"), req)
 	if err != nil {
-		log.Errorln("failed to marshal req obj", err)
 		return nil, err
 	}
-	httpreq, err := http.NewRequest("POST", URL, bytes.NewBuffer(reqJ))
-	if err != nil {
-		log.Errorln("failed to compose request:", err)
+	log.WithField("job", job.ID).Debug("Submitted compile job")
+	id := job.ID
+	jobURL := routeURL(api.route("jobs"), id)
+	for job.Status == JobQueued || job.Status == JobRunning {
+		select {
+		case <-time.After(JobPollInterval):
+			job, err = doJob(ctx, "GET", api, jobURL, nil)
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			// ctx is done, so the job is cancelled without it
+			if _, err := doJob(context.Background(), "DELETE", api, jobURL, nil); err != nil {
+				log.WithField("job", id).Debugf("Could not cancel compile job: %s", err)
+			}
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.WithFields(log.Fields{
+			"job":    job.ID,
+			"status": job.Status,
+		}).Debug("Polled compile job")
+	}
+	if job.Status == JobDone {
+		return job.Response, nil
+	}
+	err = jobError(job)
+	log.WithField("job", job.ID).Debugf("Compile job failed: %s", err)
+	if job.Response != nil {
+		return job.Response, err
+	} else if errors.Is(err, ErrCompileFailed) {
+		return compilerResponse("", "", "", "", "", err), err
+	}
+	return nil, err
+}
+
+// the error a failed job failed with
+func jobError(job *Job) *ServerError {
+	err := &ServerError{Code: job.Code, Message: job.Error}
+	for status, code := range statusCodes {
+		if code == job.Code {
+			err.StatusCode = status
+		}
+	}
+	return err
+}
+
+// send a request to the jobs API of the server and decode the job it answers
+// with
+func doJob(ctx context.Context, method string, api serverAPI, URL string, req *definitions.Request) (*Job, error) {
+	var reqJ interface{}
+	if req != nil {
+		reqJ = req
+	}
+	if api.version == "" {
+		job := new(Job)
+		if err := doJSON(ctx, method, URL, reqJ, job); err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+	if req != nil {
+		reqJ = requestToV1(req)
+	}
+	job := new(v1.Job)
+	if err := doJSON(ctx, method, URL, reqJ, job); err != nil {
 		return nil, err
 	}
-	httpreq.Header.Set("Content-Type", "application/json")
+	return jobFromV1(job), nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(httpreq)
-	if err != nil {
-		log.Errorln("failed to send HTTP request", err)
+// compile req on the server with send, uploading only the scripts the server
+// does not already hold. Servers which fail to negotiate, such as those
+// without the negotiation route, are sent the full request.
+func negotiateCompile(ctx context.Context, req *definitions.Request, api serverAPI,
+	send func(serverAPI, context.Context, *definitions.Request) (*Response, error)) (*Response, error) {
+	negotiation, err := requestNegotiation(ctx, req.Negotiation(), api.route("negotiate"))
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		log.WithField("err", err).Debug("Server did not negotiate, sending all includes")
+		return send(api, ctx, req)
+	} else if err != nil {
 		return nil, err
 	}
+	log.WithFields(log.Fields{
+		"missing": negotiation.Missing,
+		"needed":  negotiation.Needed,
+	}).Debug("Cache negotiation")
+
+	if len(negotiation.Missing) == 0 {
+		return &Response{
+			Objects: negotiation.Objects,
+			Warning: "",
+			Error:   "",
+		}, nil
+	}
+
+	needed := make(map[string]bool, len(negotiation.Needed))
+	for _, name := range negotiation.Needed {
+		needed[name] = true
+	}
+	trimmed := *req
+	trimmed.Includes = make(map[string]*definitions.IncludedFiles, len(req.Includes))
+	for name, include := range req.Includes {
+		if needed[name] {
+			trimmed.Includes[name] = include
+		} else {
+			trimmed.Includes[name] = &definitions.IncludedFiles{ObjectNames: include.ObjectNames}
+		}
+	}
+	return send(api, ctx, &trimmed)
+}
+
+// the other routes of the server live next to the compile route
+func routeURL(compileURL string, route ...string) string {
+	u, err := url.Parse(compileURL)
+	if err != nil {
+		return compileURL
+	}
+	u.Path = path.Join(append([]string{"/", u.Path}, route...)...)
+	return u.String()
+}
+
+// How many times a request turned away with 429 Too Many Requests is retried
+const maxRetries = 5
+
+// Longest a request turned away is retried after, such as when the server is
+// busy rather than the client over a daily quota
+const maxRetryWait = time.Minute
+
+// send req, if not nil, marshalled to URL and unmarshal the reply into respJ.
+// Requests the server is too busy for are retried after the delay it asks for.
+// Errors the server answers with are returned as a *ServerError. The request
+// is abandoned when ctx is done.
+func doJSON(ctx context.Context, method, URL string, req interface{}, respJ interface{}) error {
+	// make request
+	var reqJ []byte
+	if req != nil {
+		var err error
+		reqJ, err = json.Marshal(req)
+		if err != nil {
+			log.Errorln("failed to marshal req obj", err)
+			return err
+		}
+	}
+
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		body, encoding := encodeBody(URL, reqJ)
+		httpreq, err := http.NewRequestWithContext(ctx, method, URL, bytes.NewBuffer(body))
+		if err != nil {
+			log.Errorln("failed to compose request:", err)
+			return err
+		}
+		if req != nil {
+			httpreq.Header.Set("Content-Type", "application/json")
+		}
+		if encoding != "" {
+			httpreq.Header.Set("Content-Encoding", encoding)
+		}
+		httpreq.Header.Set("Accept-Encoding", strings.Join(encodings, ", "))
+		if Client.Token != "" {
+			httpreq.Header.Set("Authorization", "Bearer "+Client.Token)
+		}
+
+		client, err := Client.httpClient()
+		if err != nil {
+			return err
+		}
+		resp, err = client.Do(httpreq)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			log.Errorln("failed to send HTTP request", err)
+			return err
+		}
+		noteEncodings(URL, resp.Header)
+		if resp.StatusCode == http.StatusUnsupportedMediaType && encoding != "" && attempt < maxRetries {
+			// the server no longer accepts compressed requests, which
+			// noteEncodings has taken note of
+			resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt == maxRetries {
+			break
+		}
+		wait := retryAfter(resp.Header.Get("Retry-After"))
+		if wait > maxRetryWait {
+			break
+		}
+		resp.Body.Close()
+		log.WithField("attempt", attempt+1).Warnf("Compile server is busy, retrying in %s", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := decodeResponse(resp); err != nil {
+		resp.Body.Close()
+		log.Errorln("failed to decompress response", err)
+		return err
+	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode > 300 {
-		return nil, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		serverErr := decodeServerError(resp.StatusCode, body)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			log.Warnf("Compile server turned the request away: %s", serverErr)
+		}
+		return serverErr
 	}
 
-	respJ := new(BinaryResponse)
 	// read in response body
 	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Errorln("failed to read response body", err)
+		return err
+	}
 	err = json.Unmarshal(body, respJ)
 	if err != nil {
 		log.Errorln("failed to unmarshal", err)
-		return nil, err
+		return err
 	}
-	return respJ, nil
+	return nil
+}
+
+// parse a Retry-After header, which holds either seconds or an HTTP date
+func retryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return time.Second
 }
@@ -0,0 +1,302 @@
+package perform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/monax/cli/log"
+)
+
+// Content encodings of request and response bodies the server speaks
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+// encodings in the order they are preferred, zstd compressing better and
+// faster
+var encodings = []string{encodingZstd, encodingGzip}
+
+// Request bodies smaller than this are sent as they are, compressing them
+// being hardly worth it
+const compressMinBytes = 1024
+
+// Largest zstd window decoded, the limit HTTP puts on the zstd content
+// coding so that a small body cannot claim a large buffer
+const zstdMaxWindow = 8 << 20
+
+// Decompress request bodies sent with Content-Encoding: zstd or gzip and
+// compress responses for clients which accept either. Every response carries
+// Accept-Encoding so that clients know they may compress their requests,
+// which servers predating compression would not understand.
+func compress(handler http.Handler) http.Handler {
+	advertised := strings.Join(encodings, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Encoding", advertised)
+
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+		case encodingZstd, encodingGzip:
+			body, err := decodeBody(encoding, r.Body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid %s body: %s", encoding, err))
+				return
+			}
+			r.Body = body
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		default:
+			writeError(w, http.StatusUnsupportedMediaType, CodeUnsupportedEncoding, "unsupported content encoding "+encoding)
+			return
+		}
+
+		// WebSocket upgrades take over the connection and compress as they
+		// negotiate themselves
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Header.Get("Upgrade") != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+// the encoding to use for a peer which sent an Accept-Encoding header, the
+// one it gives the highest nonzero quality with ties going to the one we
+// prefer. Empty if it accepts none of ours.
+func negotiateEncoding(header string) string {
+	best, bestQuality := "", 0.0
+	for _, encoding := range encodings {
+		if q := quality(header, encoding); q > bestQuality {
+			best, bestQuality = encoding, q
+		}
+	}
+	return best
+}
+
+// quality an Accept-Encoding header gives coding, either by name or as any
+// encoding, zero if it lists neither
+func quality(header, coding string) float64 {
+	named, any := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != coding && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if param := strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			}
+		}
+		if name == coding {
+			named = q
+		} else {
+			any = q
+		}
+	}
+	switch {
+	case named >= 0:
+		return named
+	case any >= 0:
+		return any
+	}
+	return 0
+}
+
+// decompressing reader of raw, a body sent with encoding
+func decodeBody(encoding string, raw io.ReadCloser) (io.ReadCloser, error) {
+	body := &decodedBody{encoding: encoding, raw: raw}
+	switch encoding {
+	case encodingGzip:
+		gz, err := gzip.NewReader(raw)
+		if err != nil {
+			return nil, err
+		}
+		body.Reader, body.close = gz, func() { gz.Close() }
+	case encodingZstd:
+		dec, err := zstd.NewReader(raw, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, err
+		}
+		body.Reader, body.close = dec, dec.Close
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+	return body, nil
+}
+
+// Decompressed body. Corrupt data is a bad request rather than a failure of
+// the server.
+type decodedBody struct {
+	io.Reader
+	encoding string
+	close    func()
+	raw      io.ReadCloser
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = invalidRequest("invalid %s body: %s", b.encoding, err)
+	}
+	return n, err
+}
+
+func (b *decodedBody) Close() error {
+	b.close()
+	return b.raw.Close()
+}
+
+// Writer of one of the encodings, both gzip and zstd writers being one
+type compressor interface {
+	io.Writer
+	Reset(io.Writer)
+	Flush() error
+	Close() error
+}
+
+// compressors of each encoding, kept for reuse
+var compressors = map[string]*sync.Pool{
+	encodingGzip: {New: func() interface{} { return gzip.NewWriter(nil) }},
+	encodingZstd: {New: func() interface{} {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+		return enc
+	}},
+}
+
+// Compresses what handlers write with encoding, unless they set an encoding
+// themselves
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	cw          compressor
+	wroteHeader bool
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if h.Get("Content-Encoding") == "" && status != http.StatusNoContent && status != http.StatusNotModified {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		w.cw = compressors[w.encoding].Get().(compressor)
+		w.cw.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.cw == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.cw.Write(p)
+}
+
+// Flush sends what has been compressed so far, for streamed responses
+func (w *compressResponseWriter) Flush() {
+	if w.cw != nil {
+		w.cw.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish the compressed body
+func (w *compressResponseWriter) Close() {
+	if w.cw == nil {
+		return
+	}
+	if err := w.cw.Close(); err != nil {
+		log.Debugf("Could not finish compressed response: %s", err)
+	}
+	compressors[w.encoding].Put(w.cw)
+	w.cw = nil
+}
+
+// Encoding the server of each host prefers for requests, for hosts whose
+// servers answered that they accept compressed requests
+var hostEncodings sync.Map
+
+// note which encoding the server of URL accepts requests in from the headers
+// of one of its responses
+func noteEncodings(URL string, header http.Header) {
+	host := hostOf(URL)
+	if encoding := negotiateEncoding(header.Get("Accept-Encoding")); encoding != "" {
+		hostEncodings.Store(host, encoding)
+	} else {
+		hostEncodings.Delete(host)
+	}
+}
+
+// body of a request to URL, compressed if it is worth it and the server is
+// known to accept it. Returns the encoding used, empty for none.
+func encodeBody(URL string, body []byte) ([]byte, string) {
+	if len(body) < compressMinBytes {
+		return body, ""
+	}
+	encoding, ok := hostEncodings.Load(hostOf(URL))
+	if !ok {
+		return body, ""
+	}
+	pool := compressors[encoding.(string)]
+	var buf bytes.Buffer
+	cw := pool.Get().(compressor)
+	defer pool.Put(cw)
+	cw.Reset(&buf)
+	if _, err := cw.Write(body); err != nil {
+		return body, ""
+	}
+	if err := cw.Close(); err != nil {
+		return body, ""
+	}
+	return buf.Bytes(), encoding.(string)
+}
+
+// Decompress the body of resp if the server compressed it. The transport
+// only does so itself for gzip, and only when it asked for it.
+func decodeResponse(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+	body, err := decodeBody(encoding, resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+func hostOf(URL string) string {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return URL
+	}
+	return u.Scheme + "://" + u.Host
+}
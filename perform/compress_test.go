@@ -0,0 +1,198 @@
+package perform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func zstdCompressed(t *testing.T, data string) []byte {
+	enc, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	return enc.EncodeAll([]byte(data), nil)
+}
+
+func TestCompress(t *testing.T) {
+	echo := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(w, r, DefaultMaxRequestBytes)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.Write(body)
+	}))
+	payload := strings.Repeat("contract A {}\n", 100)
+
+	// compressed requests are decompressed, and responses compressed for
+	// clients which accept it
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(gzipped(t, payload)))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.5")
+	w := httptest.NewRecorder()
+	echo.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "zstd, gzip", w.Header().Get("Accept-Encoding"))
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(body))
+
+	// as are zstd ones, zstd being preferred for clients which accept both
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(zstdCompressed(t, payload)))
+	req.Header.Set("Content-Encoding", "zstd")
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	w = httptest.NewRecorder()
+	echo.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "zstd", w.Header().Get("Content-Encoding"))
+	dec, err := zstd.NewReader(w.Body)
+	require.NoError(t, err)
+	defer dec.Close()
+	body, err = ioutil.ReadAll(dec)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(body))
+
+	// unless they would rather have gzip
+	req = httptest.NewRequest("POST", "/", strings.NewReader(payload))
+	req.Header.Set("Accept-Encoding", "zstd;q=0.5, gzip")
+	w = httptest.NewRecorder()
+	echo.ServeHTTP(w, req)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+	// and not for those which do not
+	req = httptest.NewRequest("POST", "/", strings.NewReader(payload))
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	w = httptest.NewRecorder()
+	echo.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, payload, w.Body.String())
+
+	// other encodings are refused
+	req = httptest.NewRequest("POST", "/", strings.NewReader(payload))
+	req.Header.Set("Content-Encoding", "br")
+	w = httptest.NewRecorder()
+	echo.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Equal(t, CodeUnsupportedEncoding, decodeServerError(w.Code, w.Body.Bytes()).Code)
+
+	// as are corrupt bodies
+	for encoding, compressed := range map[string][]byte{
+		"gzip": gzipped(t, payload),
+		"zstd": zstdCompressed(t, payload),
+	} {
+		compressed[len(compressed)/2] ^= 0xff
+		req = httptest.NewRequest("POST", "/", bytes.NewReader(compressed))
+		req.Header.Set("Content-Encoding", encoding)
+		w = httptest.NewRecorder()
+		echo.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, encoding)
+	}
+}
+
+func TestClientCompressesRequests(t *testing.T) {
+	var encodings []string
+	var responseEncoding string
+	handler := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(w, r, DefaultMaxRequestBytes)
+		require.NoError(t, err)
+		writeJSON(w, http.StatusOK, map[string]int{"length": len(body)})
+		responseEncoding = w.Header().Get("Content-Encoding")
+	}))
+	// servers predating zstd only say they accept gzip
+	gzipOnly := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		if gzipOnly {
+			w = acceptGzipOnly{w}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	payload := strings.Repeat("x", 2*compressMinBytes)
+	var resp map[string]int
+	// until the server has said it accepts compressed requests, they are
+	// sent as they are
+	for i := 0; i < 2; i++ {
+		require.NoError(t, doJSON(context.Background(), "POST", server.URL, payload, &resp))
+		assert.Equal(t, len(payload)+2, resp["length"])
+	}
+	// as are small ones
+	require.NoError(t, doJSON(context.Background(), "POST", server.URL, "small", &resp))
+	assert.Equal(t, []string{"", "zstd", ""}, encodings)
+	// responses to the client are compressed too, and decompressed by it
+	assert.Equal(t, "zstd", responseEncoding)
+
+	gzipOnly = true
+	encodings = nil
+	for i := 0; i < 2; i++ {
+		require.NoError(t, doJSON(context.Background(), "POST", server.URL, payload, &resp))
+		assert.Equal(t, len(payload)+2, resp["length"])
+	}
+	assert.Equal(t, []string{"zstd", "gzip"}, encodings)
+}
+
+// Answers as a server which only accepts gzip requests would
+type acceptGzipOnly struct {
+	http.ResponseWriter
+}
+
+func (w acceptGzipOnly) WriteHeader(status int) {
+	w.Header().Set("Accept-Encoding", "gzip")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func TestHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files, err := SelfSigned(dir, []string{"localhost"})
+	require.NoError(t, err)
+	defer func() { Client = ClientConfig{} }()
+
+	srv, err := StartServer(context.Background(), ServerConfig{
+		AddrSecure: "localhost:9098",
+		CertFile:   files.CertFile,
+		KeyFile:    files.KeyFile,
+	})
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, srv.Close())
+		assertShutdown(t, srv)
+	}()
+
+	Client = ClientConfig{CAFingerprint: files.Fingerprint}
+	client, err := Client.httpClient()
+	require.NoError(t, err)
+	resp, err := client.Get("https://localhost:9098/version")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	// the transport asked for and decompressed the response itself
+	assert.True(t, resp.Uncompressed)
+	version := new(VersionResponse)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(version))
+	assert.NotEmpty(t, version.Version)
+}
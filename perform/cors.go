@@ -0,0 +1,98 @@
+package perform
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monax/cli/log"
+)
+
+// Cross-origin requests the server accepts, such as from web IDEs
+type CORSConfig struct {
+	// Origins allowed to call the server, "*" for any. Empty disables CORS.
+	AllowedOrigins []string
+	// Methods and request headers allowed, default to
+	// DefaultCORSMethods and DefaultCORSHeaders
+	AllowedMethods []string
+	AllowedHeaders []string
+	// How long browsers may cache the answer to a preflight request
+	MaxAge time.Duration
+}
+
+var (
+	DefaultCORSMethods = []string{"GET", "POST", "DELETE"}
+	DefaultCORSHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// Response headers scripts may read
+var corsExposedHeaders = []string{"Retry-After", "WWW-Authenticate"}
+
+func (c *CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer CORS preflight requests to handler and let the origins of conf read
+// the responses to the rest. Preflights from other origins are answered with
+// 403 Forbidden.
+func withCORS(conf *CORSConfig, handler http.Handler) http.Handler {
+	methods := conf.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	headers := conf.AllowedHeaders
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := conf.allowsOrigin(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			if !allowed {
+				log.WithField("origin", origin).Warn("Refusing cross-origin request")
+				writeError(w, http.StatusForbidden, CodeForbidden, "origin not allowed")
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			if conf.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(conf.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Accept WebSocket upgrades from the server's own origin and, when CORS is
+// enabled, from the origins conf allows
+func checkOrigin(conf *CORSConfig, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if conf != nil && conf.allowsOrigin(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
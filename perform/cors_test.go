@@ -0,0 +1,82 @@
+package perform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORS(t *testing.T) {
+	conf := &CORSConfig{
+		AllowedOrigins: []string{"https://ide.example"},
+		MaxAge:         time.Minute,
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+	testServer := httptest.NewServer(withCORS(conf, ok))
+	defer testServer.Close()
+
+	request := func(method, origin string) *http.Response {
+		req, err := http.NewRequest(method, testServer.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := request(http.MethodOptions, "https://ide.example")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://ide.example", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, POST, DELETE", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type", resp.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "60", resp.Header.Get("Access-Control-Max-Age"))
+
+	resp = request(http.MethodOptions, "https://evil.example")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = request(http.MethodPost, "https://ide.example")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "https://ide.example", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "Retry-After")
+
+	// the browser rather than the server refuses other origins the response
+	resp = request(http.MethodPost, "https://evil.example")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestStreamCheckOrigin(t *testing.T) {
+	server, closeServer := withTestServer()
+	defer closeServer()
+	testServer := httptest.NewServer(http.HandlerFunc(server.StreamHandler))
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http")
+
+	dial := func(origin string) error {
+		header := http.Header{"Origin": {origin}}
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	assert.NoError(t, dial(testServer.URL))
+	assert.Error(t, dial("https://ide.example"))
+
+	server.cors = &CORSConfig{AllowedOrigins: []string{"https://ide.example"}}
+	assert.NoError(t, dial("https://ide.example"))
+	assert.Error(t, dial("https://evil.example"))
+}
@@ -0,0 +1,188 @@
+package perform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/monax/cli/log"
+)
+
+// Envelope of every error the server answers with
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	// one of the Code constants
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// such as the diagnostics of a failed compile
+	Details []string `json:"details,omitempty"`
+}
+
+// Error codes and the statuses they are sent with
+const (
+	CodeBadRequest          = "bad_request"          // 400
+	CodeUnauthorized        = "unauthorized"         // 401
+	CodeForbidden           = "forbidden"            // 403
+	CodeNotFound            = "not_found"            // 404
+	CodeMethodNotAllowed    = "method_not_allowed"   // 405
+	CodeTooLarge            = "request_too_large"    // 413
+	CodeUnsupportedEncoding = "unsupported_encoding" // 415
+	CodeCompileFailed       = "compile_failed"       // 422
+	CodeRateLimited         = "rate_limited"         // 429
+	CodeInternal            = "internal"             // 500
+	CodeCompilerUnavailable = "compiler_unavailable" // 503
+)
+
+// Errors returned by the client, test for them with errors.Is
+var (
+	ErrBadRequest          = errors.New("bad request")
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrForbidden           = errors.New("forbidden")
+	ErrNotFound            = errors.New("not found")
+	ErrMethodNotAllowed    = errors.New("method not allowed")
+	ErrTooLarge            = errors.New("request too large")
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	ErrCompileFailed       = errors.New("compile failed")
+	ErrRateLimited         = errors.New("rate limited")
+	ErrInternal            = errors.New("internal server error")
+	ErrCompilerUnavailable = errors.New("compiler unavailable")
+)
+
+var codeErrors = map[string]error{
+	CodeBadRequest:          ErrBadRequest,
+	CodeUnauthorized:        ErrUnauthorized,
+	CodeForbidden:           ErrForbidden,
+	CodeNotFound:            ErrNotFound,
+	CodeMethodNotAllowed:    ErrMethodNotAllowed,
+	CodeTooLarge:            ErrTooLarge,
+	CodeUnsupportedEncoding: ErrUnsupportedEncoding,
+	CodeCompileFailed:       ErrCompileFailed,
+	CodeRateLimited:         ErrRateLimited,
+	CodeInternal:            ErrInternal,
+	CodeCompilerUnavailable: ErrCompilerUnavailable,
+}
+
+// codes of responses from servers which do not send the envelope
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusRequestEntityTooLarge: CodeTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedEncoding,
+	http.StatusUnprocessableEntity:   CodeCompileFailed,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusServiceUnavailable:    CodeCompilerUnavailable,
+}
+
+// The compiler could not be run at all, as opposed to failing to compile
+var errCompilerUnavailable = errors.New("compiler unavailable")
+
+// Error answered by a compile server. It is errors.Is the Err value of its
+// code.
+type ServerError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Details    []string
+}
+
+func (e *ServerError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("HTTP error: %d", e.StatusCode)
+	}
+	return e.Message
+}
+
+func (e *ServerError) Is(target error) bool {
+	return codeErrors[e.Code] == target
+}
+
+// decode the envelope of an error response, falling back to the body as the
+// message for servers which do not send one
+func decodeServerError(statusCode int, body []byte) *ServerError {
+	errResp := new(ErrorResponse)
+	if err := json.Unmarshal(body, errResp); err == nil && errResp.Error.Code != "" {
+		return &ServerError{
+			StatusCode: statusCode,
+			Code:       errResp.Error.Code,
+			Message:    errResp.Error.Message,
+			Details:    errResp.Error.Details,
+		}
+	}
+	return &ServerError{
+		StatusCode: statusCode,
+		Code:       statusCodes[statusCode],
+		Message:    strings.TrimSpace(string(body)),
+	}
+}
+
+// the error of a compile or link the legacy routes answered with 200 OK and
+// message as the response's Error, nil if it did not fail
+func legacyError(message string) error {
+	if message == "" {
+		return nil
+	}
+	return &ServerError{
+		StatusCode: http.StatusOK,
+		Code:       CodeCompileFailed,
+		Message:    message,
+	}
+}
+
+// answer a request with the error envelope
+func writeError(w http.ResponseWriter, status int, code, message string, details ...string) {
+	writeJSON(w, status, &ErrorResponse{
+		Error: ErrorBody{
+			Code:    code,
+			Message: message,
+			Details: details,
+		},
+	})
+}
+
+// status and code to answer a request which failed with err
+func errorStatus(err error) (int, string) {
+	switch err.(type) {
+	case invalidRequestError:
+		return http.StatusBadRequest, CodeBadRequest
+	case requestTooLargeError:
+		return http.StatusRequestEntityTooLarge, CodeTooLarge
+	}
+	switch {
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout):
+		return http.StatusTooManyRequests, CodeRateLimited
+	case errors.Is(err, errCompilerUnavailable):
+		return http.StatusServiceUnavailable, CodeCompilerUnavailable
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
+
+// answer a request which failed with err
+func writeServerError(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	if errors.Is(err, context.Canceled) {
+		log.Debugf("Request cancelled: %s", err)
+	} else if status == http.StatusInternalServerError {
+		log.Errorln("err serving request", err)
+	}
+	writeError(w, status, code, err.Error())
+}
+
+// answer a request whose compile failed with the compiler's output and the
+// diagnostics parsed from it
+func writeCompileError(w http.ResponseWriter, resp *Response) {
+	var details []string
+	for _, diagnostic := range diagnostics(resp.Error, nil) {
+		details = append(details, diagnostic.Message)
+	}
+	writeError(w, http.StatusUnprocessableEntity, CodeCompileFailed, resp.Error, details...)
+}
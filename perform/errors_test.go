@@ -0,0 +1,81 @@
+package perform
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/monax/compilers/definitions"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorResponses(t *testing.T) {
+	invocations, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.CompileHandler)
+	mux.HandleFunc("/binaries", server.BinaryHandler)
+	mux.HandleFunc("/v1/compile", server.CompileV1Handler)
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "A", "contract A { boom }\n")
+
+	// the compiler reports an error
+	resp, err := requestV1Response(context.Background(), req, testServer.URL+"/v1/compile")
+	assert.True(t, errors.Is(err, ErrCompileFailed), "%v", err)
+	require.NotNil(t, resp)
+	assert.Contains(t, resp.Error, "Error: boom")
+	var serverErr *ServerError
+	require.True(t, errors.As(err, &serverErr))
+	assert.Equal(t, http.StatusUnprocessableEntity, serverErr.StatusCode)
+	require.Len(t, serverErr.Details, 1)
+	assert.Contains(t, serverErr.Details[0], "Error: boom")
+
+	// while the legacy route answers 200 with the error in the response
+	resp, err = requestResponse(context.Background(), req, testServer.URL)
+	assert.True(t, errors.Is(err, ErrCompileFailed), "%v", err)
+	require.NotNil(t, resp)
+	assert.Contains(t, resp.Error, "Error: boom")
+	require.True(t, errors.As(err, &serverErr))
+	assert.Equal(t, http.StatusOK, serverErr.StatusCode)
+
+	// the compiler cannot be run
+	require.NoError(t, os.Remove(path.Join(path.Dir(invocations), "compiler.sh")))
+	_, err = requestResponse(context.Background(), req, testServer.URL)
+	assert.True(t, errors.Is(err, ErrCompilerUnavailable), "%v", err)
+
+	// bad requests are answered with the envelope alone
+	httpResp, err := http.Post(testServer.URL+"/binaries", "application/json", strings.NewReader("{"))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, httpResp.StatusCode)
+	assert.True(t, strings.HasPrefix(string(body), `{"error":{"code":"bad_request"`), string(body))
+	assert.Equal(t, 1, strings.Count(string(body), "{\"error\""))
+}
+
+func TestDecodeServerError(t *testing.T) {
+	err := decodeServerError(http.StatusNotFound, []byte("404 page not found\n"))
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, "404 page not found", err.Error())
+
+	err = decodeServerError(http.StatusBadGateway, nil)
+	assert.False(t, errors.Is(err, ErrInternal))
+	assert.Equal(t, "HTTP error: 502", err.Error())
+}
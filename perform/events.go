@@ -0,0 +1,135 @@
+package perform
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+)
+
+// Progress of a compile as reported to streaming clients
+type CompileEvent struct {
+	Type     string    `json:"type"`
+	Include  string    `json:"include,omitempty"`  // include the event concerns
+	File     string    `json:"file,omitempty"`     // client's name for the include
+	Imports  []string  `json:"imports,omitempty"`  // includes imported by Include
+	Severity string    `json:"severity,omitempty"` // of a diagnostic, warning or error
+	Message  string    `json:"message,omitempty"`
+	Response *Response `json:"response,omitempty"` // final response
+}
+
+// Types of CompileEvent, in the order they are sent
+const (
+	EventImport       = "import"        // an include was resolved, Message says whether it was uploaded or stored
+	EventCacheHit     = "cache-hit"     // an include was found in the cache
+	EventCacheMiss    = "cache-miss"    // an include has to be compiled
+	EventCompileStart = "compile-start" // the compiler was started on the includes listed in Message
+	EventDiagnostic   = "diagnostic"    // the compiler reported a warning or error, sent as it does
+	EventResponse     = "response"      // the request is done, carries the Response
+	EventError        = "error"         // the request failed, Message says why
+)
+
+type eventSinkKey struct{}
+
+// Send the events of compiles run with the returned context to sink
+func withEventSink(ctx context.Context, sink func(CompileEvent)) context.Context {
+	return context.WithValue(ctx, eventSinkKey{}, sink)
+}
+
+// the event sink of ctx, if it has one
+func eventSink(ctx context.Context) (func(CompileEvent), bool) {
+	sink, ok := ctx.Value(eventSinkKey{}).(func(CompileEvent))
+	return sink, ok
+}
+
+// send an event to the sink of ctx, if it has one
+func emit(ctx context.Context, event CompileEvent) {
+	if sink, ok := eventSink(ctx); ok {
+		sink(event)
+	}
+}
+
+// matches the first line of a solc diagnostic, e.g.
+// <file>:3:5: Warning: Unused local variable
+var diagnosticPattern = regexp.MustCompile(`^(\S+?):(\d+):(\d+): (\w*(?:Error|Warning)): (.*)$`)
+
+// Split compiler output into its diagnostics, each of which runs from a line
+// matching diagnosticPattern up to the next one. Include names are replaced by
+// the client's file names.
+func diagnostics(output string, fileNames map[string]string) []CompileEvent {
+	var events []CompileEvent
+	w := &diagnosticWriter{
+		fileNames: fileNames,
+		emit:      func(event CompileEvent) { events = append(events, event) },
+	}
+	w.Write([]byte(output))
+	w.Close()
+	return events
+}
+
+// Splits compiler output into diagnostics as it is written, sending each to
+// emit as soon as the start of the next one, or the end of the output, shows
+// where it ends
+type diagnosticWriter struct {
+	fileNames map[string]string
+	emit      func(CompileEvent)
+	// the line being written and the diagnostic it may continue
+	line    []byte
+	pending *CompileEvent
+}
+
+func (w *diagnosticWriter) Write(p []byte) (int, error) {
+	w.line = append(w.line, p...)
+	for {
+		end := bytes.IndexByte(w.line, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		w.parse(string(w.line[:end]))
+		w.line = w.line[end+1:]
+	}
+}
+
+// Close sends the diagnostic the output ended with
+func (w *diagnosticWriter) Close() error {
+	if len(w.line) > 0 {
+		w.parse(string(w.line))
+		w.line = nil
+	}
+	if w.pending != nil {
+		w.emit(*w.pending)
+		w.pending = nil
+	}
+	return nil
+}
+
+func (w *diagnosticWriter) parse(line string) {
+	if m := diagnosticPattern.FindStringSubmatch(line); m != nil {
+		if w.pending != nil {
+			w.emit(*w.pending)
+		}
+		severity := "error"
+		if m[4] == "Warning" {
+			severity = "warning"
+		}
+		w.pending = &CompileEvent{
+			Type:     EventDiagnostic,
+			Include:  m[1],
+			File:     w.fileNames[m[1]],
+			Severity: severity,
+		}
+	}
+	if w.pending != nil {
+		if w.pending.Message != "" {
+			w.pending.Message += "\n"
+		}
+		w.pending.Message += replaceFileNames(line, w.fileNames)
+	}
+}
+
+func replaceFileNames(s string, fileNames map[string]string) string {
+	for name, file := range fileNames {
+		s = strings.Replace(s, name, file, -1)
+	}
+	return s
+}
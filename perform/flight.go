@@ -0,0 +1,197 @@
+package perform
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/monax/compilers/definitions"
+)
+
+// Coalesces concurrent compiles of the same request into a single compile
+// whose result is shared by every caller
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	resp *Response
+	err  error
+	// number of callers still waiting, the call is cancelled when none are
+	callers int
+	cancel  context.CancelFunc
+
+	// events and CPU time of the call so far, passed on to callers joining
+	// it late, and the event sinks and CPU charges of the callers waiting on
+	// it
+	mu       sync.Mutex
+	events   []CompileEvent
+	cpu      time.Duration
+	sinks    map[int]func(CompileEvent)
+	charges  map[int]func(time.Duration)
+	lastSink int
+}
+
+// send the events of the call to the event sink of ctx and charge its CPU
+// time to the CPU charge of ctx, if it has them, starting with the events
+// sent and CPU time used so far. Returns the id to unsubscribe ctx by.
+func (c *flightCall) subscribe(ctx context.Context) int {
+	sink, hasSink := eventSink(ctx)
+	charge, hasCharge := cpuCharge(ctx)
+	if !hasSink && !hasCharge {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastSink++
+	if hasSink {
+		for _, event := range c.events {
+			sink(event)
+		}
+		c.sinks[c.lastSink] = sink
+	}
+	if hasCharge {
+		if c.cpu > 0 {
+			charge(c.cpu)
+		}
+		c.charges[c.lastSink] = charge
+	}
+	return c.lastSink
+}
+
+func (c *flightCall) unsubscribe(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sinks, id)
+	delete(c.charges, id)
+}
+
+// send an event of the call to every caller waiting on it
+func (c *flightCall) emit(event CompileEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, event)
+	for _, sink := range c.sinks {
+		sink(event)
+	}
+}
+
+// charge CPU time used by the call to every caller waiting on it
+func (c *flightCall) charge(cpu time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cpu += cpu
+	for _, charge := range c.charges {
+		charge(cpu)
+	}
+}
+
+var (
+	compileFlights = &flightGroup{}
+
+	// number of requests which ran their own compile and number which waited
+	// on an identical one already in flight
+	flightsLed       uint64
+	flightsCoalesced uint64
+)
+
+// Run fn unless a call with the same key is already in flight, in which case
+// wait for that call and return its result. shared reports whether the result
+// came from another caller's call.
+//
+// fn is passed the values of ctx, and is cancelled only once every caller
+// waiting on it has had its ctx done, so that one client going away does not
+// fail the others. Callers other than the first return as soon as their ctx
+// is done. The events fn sends go to the event sinks of every caller, and the
+// CPU time it charges is charged to every caller.
+func (g *flightGroup) do(ctx context.Context, key string,
+	fn func(context.Context) (*Response, error)) (resp *Response, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		c.callers++
+		g.mu.Unlock()
+		atomic.AddUint64(&flightsCoalesced, 1)
+		sink := c.subscribe(ctx)
+		defer c.unsubscribe(sink)
+		select {
+		case <-c.done:
+			return c.resp, c.err, true
+		case <-ctx.Done():
+			g.leave(key, c)
+			return nil, ctx.Err(), true
+		}
+	}
+	callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	c := &flightCall{
+		done:    make(chan struct{}),
+		callers: 1,
+		cancel:  cancel,
+		sinks:   make(map[int]func(CompileEvent)),
+		charges: make(map[int]func(time.Duration)),
+	}
+	g.calls[key] = c
+	g.mu.Unlock()
+	atomic.AddUint64(&flightsLed, 1)
+
+	sink := c.subscribe(ctx)
+	stop := context.AfterFunc(ctx, func() {
+		c.unsubscribe(sink)
+		g.leave(key, c)
+	})
+	defer func() {
+		stop()
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		cancel()
+		close(c.done)
+	}()
+	c.resp, c.err = fn(withCPUCharge(withEventSink(callCtx, c.emit), c.charge))
+	return c.resp, c.err, false
+}
+
+// stop waiting on c, cancelling it if no one else is. Later calls with the
+// same key start afresh rather than join the cancelled call.
+func (g *flightGroup) leave(key string, c *flightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c.callers--
+	if c.callers > 0 {
+		return
+	}
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	c.cancel()
+}
+
+// Number of compiles run by the server and of requests coalesced into them
+func CoalesceStats() (led, coalesced uint64) {
+	return atomic.LoadUint64(&flightsLed), atomic.LoadUint64(&flightsCoalesced)
+}
+
+// Requests with the same key compile to the same response. Includes are named
+// after the hash of their script, so the names stand in for the scripts.
+func requestKey(req *definitions.Request) string {
+	names := make([]string, 0, len(req.Includes))
+	for name := range req.Includes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// json.Marshal sorts the keys of FileReplacement
+	key, _ := json.Marshal([]interface{}{req.Language, req.Optimize, req.Libraries, names, req.FileReplacement})
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,200 @@
+package perform
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	g := &flightGroup{}
+	release := make(chan struct{})
+	var calls int32
+	want := &Response{Warning: "shared"}
+	fn := func(context.Context) (*Response, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return want, nil
+	}
+
+	_, coalescedBefore := CoalesceStats()
+	var wg sync.WaitGroup
+	results := make(chan bool, 4)
+	go func() {
+		_, _, shared := g.do(context.Background(), "key", fn)
+		results <- shared
+	}()
+	// wait for the leader to be in flight before piling on
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err, shared := g.do(context.Background(), "key", fn)
+			assert.NoError(t, err)
+			assert.Equal(t, want, resp)
+			results <- shared
+		}()
+	}
+	for {
+		if _, coalesced := CoalesceStats(); coalesced-coalescedBefore == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	sharedCount := 0
+	for i := 0; i < 4; i++ {
+		if <-results {
+			sharedCount++
+		}
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, 3, sharedCount)
+
+	// a later call with the same key compiles afresh
+	_, _, shared := g.do(context.Background(), "key", func(context.Context) (*Response, error) { return want, nil })
+	assert.False(t, shared)
+}
+
+func TestFlightGroupCancels(t *testing.T) {
+	g := &flightGroup{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var cancelled int32
+	fn := func(ctx context.Context) (*Response, error) {
+		close(started)
+		select {
+		case <-release:
+			return &Response{}, nil
+		case <-ctx.Done():
+			atomic.AddInt32(&cancelled, 1)
+			return nil, ctx.Err()
+		}
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err, _ := g.do(leaderCtx, "key", fn)
+		leader <- err
+	}()
+	<-started
+
+	// a caller giving up returns at once, leaving the call to the others
+	waiterCtx, cancelWaiter := context.WithCancel(context.Background())
+	waiter := make(chan error, 1)
+	go func() {
+		_, err, _ := g.do(waiterCtx, "key", fn)
+		waiter <- err
+	}()
+	cancelWaiter()
+	assert.Equal(t, context.Canceled, <-waiter)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&cancelled))
+
+	// the call is cancelled once every caller has given up
+	cancelLeader()
+	assert.Equal(t, context.Canceled, <-leader)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cancelled))
+
+	// and later calls start afresh
+	_, err, shared := g.do(context.Background(), "key", func(context.Context) (*Response, error) { return &Response{}, nil })
+	assert.NoError(t, err)
+	assert.False(t, shared)
+}
+
+func TestFlightGroupSharesEvents(t *testing.T) {
+	g := &flightGroup{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (*Response, error) {
+		emit(ctx, CompileEvent{Type: EventCompileStart})
+		close(started)
+		<-release
+		emit(ctx, CompileEvent{Type: EventDiagnostic})
+		return &Response{}, nil
+	}
+	var leader, waiter []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx := withEventSink(context.Background(), func(event CompileEvent) { leader = append(leader, event.Type) })
+		g.do(ctx, "key", fn)
+	}()
+	<-started
+
+	// a caller joining late is sent the events it missed
+	ctx := withEventSink(context.Background(), func(event CompileEvent) { waiter = append(waiter, event.Type) })
+	go func() {
+		for sinkCount(g, "key") < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+	}()
+	_, _, shared := g.do(ctx, "key", fn)
+	<-done
+	assert.True(t, shared)
+	assert.Equal(t, []string{EventCompileStart, EventDiagnostic}, leader)
+	assert.Equal(t, leader, waiter)
+}
+
+func TestFlightGroupSharesCPU(t *testing.T) {
+	g := &flightGroup{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (*Response, error) {
+		chargeCPU(ctx, time.Second)
+		close(started)
+		<-release
+		chargeCPU(ctx, 2*time.Second)
+		return &Response{}, nil
+	}
+	var leader, waiter time.Duration
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx := withCPUCharge(context.Background(), func(cpu time.Duration) { leader += cpu })
+		g.do(ctx, "key", fn)
+	}()
+	<-started
+
+	// a caller joining late is charged for the CPU time used so far
+	ctx := withCPUCharge(context.Background(), func(cpu time.Duration) { waiter += cpu })
+	go func() {
+		for subscriberCount(g, "key", func(c *flightCall) int { return len(c.charges) }) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+	}()
+	_, _, shared := g.do(ctx, "key", fn)
+	<-done
+	assert.True(t, shared)
+	assert.Equal(t, 3*time.Second, leader)
+	assert.Equal(t, leader, waiter)
+}
+
+// number of callers of the call with key which receive its events
+func sinkCount(g *flightGroup, key string) int {
+	return subscriberCount(g, key, func(c *flightCall) int { return len(c.sinks) })
+}
+
+// number of callers of the call with key counted by count
+func subscriberCount(g *flightGroup, key string, count func(*flightCall) int) int {
+	g.mu.Lock()
+	c := g.calls[key]
+	g.mu.Unlock()
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return count(c)
+}
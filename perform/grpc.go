@@ -0,0 +1,571 @@
+package perform
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/definitions/pb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/monax/cli/log"
+	netcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Scopes required of the methods of the gRPC service, public methods are
+// left out
+var grpcScopes = map[string]string{
+	"/compilers.Compilers/Compile":       ScopeCompile,
+	"/compilers.Compilers/CompileStream": ScopeCompile,
+	"/compilers.Compilers/Link":          ScopeLink,
+}
+
+// gRPC codes of the statuses errors are answered with over HTTP
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusInternalServerError:   codes.Internal,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+}
+
+// HTTP statuses of gRPC codes, for metrics and the errors of GRPCClient
+var grpcStatuses = map[codes.Code]int{
+	codes.OK:                http.StatusOK,
+	codes.InvalidArgument:   http.StatusBadRequest,
+	codes.Unauthenticated:   http.StatusUnauthorized,
+	codes.PermissionDenied:  http.StatusForbidden,
+	codes.NotFound:          http.StatusNotFound,
+	codes.Unimplemented:     http.StatusNotFound,
+	codes.ResourceExhausted: http.StatusTooManyRequests,
+	codes.Internal:          http.StatusInternalServerError,
+	codes.Unavailable:       http.StatusServiceUnavailable,
+}
+
+// The vendored grpc predates the context package, its interfaces take
+// golang.org/x/net/context whose Context is interchangeable with ours.
+
+// gRPC server of the compile service, see definitions/pb/compilers.proto.
+// Clients are authorized and limited as they are over HTTP.
+func (s *Server) newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.MaxMsgSize(int(s.maxRequestBytes)),
+		grpc.UnaryInterceptor(s.guardUnary),
+		grpc.StreamInterceptor(s.guardStream),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	srv := grpc.NewServer(opts...)
+	pb.RegisterCompilersServer(srv, compilersService{s})
+	return srv
+}
+
+// answer a call which failed with err with the code of the status it would be
+// answered with over HTTP
+func rpcError(err error) error {
+	status, _ := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Errorln("err serving call", err)
+	}
+	return grpc.Errorf(grpcCodes[status], "%s", err)
+}
+
+func (s *Server) guardUnary(ctx netcontext.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, done, err := s.guardCall(ctx, info.FullMethod)
+	if err != nil {
+		done(err, 0, 0)
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	in, out := messageSize(req), 0
+	if resp != nil {
+		out = messageSize(resp)
+	}
+	done(err, in, out)
+	return resp, err
+}
+
+func (s *Server) guardStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	ctx, done, err := s.guardCall(stream.Context(), info.FullMethod)
+	if err == nil {
+		err = handler(srv, &guardedStream{ServerStream: stream, ctx: ctx})
+	}
+	done(err, 0, 0)
+	return err
+}
+
+// stream whose context is that of the guard
+type guardedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *guardedStream) Context() netcontext.Context {
+	return s.ctx
+}
+
+func messageSize(m interface{}) int {
+	if msg, ok := m.(proto.Message); ok {
+		return proto.Size(msg)
+	}
+	return 0
+}
+
+// Authorize and limit a call of method, as authorize and limit do requests.
+// done records the call once it has been answered.
+func (s *Server) guardCall(ctx context.Context, method string) (context.Context,
+	func(err error, in, out int), error) {
+	var cert *x509.Certificate
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if chains := tlsInfo.State.VerifiedChains; len(chains) > 0 && len(chains[0]) > 0 {
+				cert = chains[0][0]
+			}
+		}
+	}
+	token := ""
+	if md, ok := metadata.FromContext(ctx); ok && len(md["authorization"]) > 0 {
+		token = strings.TrimSpace(strings.TrimPrefix(md["authorization"][0], "Bearer "))
+	}
+	key := s.clientKeyOf(cert, token, remoteAddr)
+	limiter := s.limits
+
+	done := func(err error, in, out int) {
+		status := grpcStatuses[grpc.Code(err)]
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		metrics.request(method, status, uint64(in), uint64(out))
+		if limiter != nil && grpcScopes[method] != "" {
+			limiter.chargeBytes(key, uint64(in))
+		}
+		fields := log.Fields{
+			"method": method,
+			"code":   grpc.Code(err).String(),
+			"remote": remoteAddr,
+		}
+		if cert != nil {
+			fields["client"] = cert.Subject.String()
+		}
+		log.WithFields(fields).Info("Served call")
+	}
+
+	scope, guarded := grpcScopes[method]
+	if !guarded {
+		return ctx, done, nil
+	}
+	if s.tokens != nil {
+		known, allowed := s.tokens.authorizeClient(cert, token, scope)
+		if !known {
+			return ctx, done, grpc.Errorf(codes.Unauthenticated, "missing or invalid API token")
+		}
+		if !allowed {
+			return ctx, done, grpc.Errorf(codes.PermissionDenied, "API token lacks the %s scope", scope)
+		}
+	}
+	if limiter != nil {
+		if reason, wait := limiter.admit(key, time.Now()); reason != "" {
+			log.WithField("client", key).Warnf("Turning call away: %s, retry in %ds",
+				reason, int(math.Ceil(wait.Seconds())))
+			return ctx, done, grpc.Errorf(codes.ResourceExhausted, "%s", reason)
+		}
+		ctx = withCPUCharge(ctx, func(cpu time.Duration) {
+			limiter.chargeCPU(key, cpu)
+		})
+	}
+	return ctx, done, nil
+}
+
+// Implements pb.CompilersServer
+type compilersService struct {
+	server *Server
+}
+
+func (c compilersService) Compile(ctx netcontext.Context, in *pb.CompileRequest) (*pb.CompileResponse, error) {
+	req, err := compileRequestFromPB(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := serveCompile(ctx, c.server.pool, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return responseToPB(resp), nil
+}
+
+func (c compilersService) CompileStream(in *pb.CompileRequest, stream pb.Compilers_CompileStreamServer) error {
+	var sendLock sync.Mutex
+	send := func(event CompileEvent) {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		if err := stream.Send(eventToPB(event)); err != nil {
+			log.WithField("type", event.Type).Debugf("Could not send event: %s", err)
+		}
+	}
+	ctx := withEventSink(stream.Context(), send)
+	req, err := compileRequestFromPB(ctx, in)
+	if err != nil {
+		return err
+	}
+	resp, err := serveCompile(ctx, c.server.pool, req)
+	if err != nil {
+		return rpcError(err)
+	}
+	send(CompileEvent{Type: EventResponse, Response: resp})
+	return nil
+}
+
+func (compilersService) Link(ctx netcontext.Context, in *pb.LinkRequest) (*pb.LinkResponse, error) {
+	resp, err := linkBinaries(ctx, &definitions.BinaryRequest{
+		BinaryFile: in.Binary,
+		Libraries:  in.Libraries,
+	})
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &pb.LinkResponse{Binary: resp.Binary, Error: resp.Error}, nil
+}
+
+func (compilersService) ListCompilers(ctx netcontext.Context, in *pb.ListCompilersRequest) (*pb.ListCompilersResponse, error) {
+	compilers := listCompilers(ctx)
+	resp := &pb.ListCompilersResponse{
+		Features:    compilers.Features,
+		ApiVersions: compilers.APIVersions,
+	}
+	for _, info := range compilers.Compilers {
+		resp.Compilers = append(resp.Compilers, &pb.CompilerInfo{
+			Language:  info.Language,
+			Installed: info.Installed,
+			Version:   info.Version,
+			Options:   info.Options,
+		})
+	}
+	return resp, nil
+}
+
+// validate a compile request and fill in the scripts the client left out, as
+// readCompileRequest does
+func compileRequestFromPB(ctx context.Context, in *pb.CompileRequest) (*definitions.Request, error) {
+	req := requestFromPB(in)
+	if err := validateRequest(req); err != nil {
+		log.Warnf("Rejecting request: %s", err)
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid request: %s", err)
+	}
+	if err := resolveScripts(ctx, req); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err)
+	}
+	return req, nil
+}
+
+func requestToPB(req *definitions.Request) *pb.CompileRequest {
+	includes := make(map[string]*pb.IncludedFiles, len(req.Includes))
+	for name, include := range req.Includes {
+		includes[name] = &pb.IncludedFiles{ObjectNames: include.ObjectNames, Script: include.Script}
+	}
+	return &pb.CompileRequest{
+		Name:        req.ScriptName,
+		Language:    req.Language,
+		Includes:    includes,
+		Libraries:   req.Libraries,
+		Optimize:    req.Optimize,
+		Replacement: req.FileReplacement,
+	}
+}
+
+func requestFromPB(in *pb.CompileRequest) *definitions.Request {
+	includes := make(map[string]*definitions.IncludedFiles, len(in.Includes))
+	for name, include := range in.Includes {
+		if include == nil {
+			include = &pb.IncludedFiles{}
+		}
+		includes[name] = &definitions.IncludedFiles{ObjectNames: include.ObjectNames, Script: include.Script}
+	}
+	return &definitions.Request{
+		ScriptName:      in.Name,
+		Language:        in.Language,
+		Includes:        includes,
+		Libraries:       in.Libraries,
+		Optimize:        in.Optimize,
+		FileReplacement: in.Replacement,
+	}
+}
+
+func responseToPB(resp *Response) *pb.CompileResponse {
+	out := &pb.CompileResponse{
+		Warning: resp.Warning,
+		Version: resp.Version,
+		Error:   resp.Error,
+		Rebuilt: resp.Rebuilt,
+		Cached:  resp.Cached,
+	}
+	for _, item := range resp.Objects {
+		out.Objects = append(out.Objects, &pb.ResponseItem{
+			Objectname: item.Objectname,
+			Bytecode:   item.Bytecode,
+			Abi:        item.ABI,
+		})
+	}
+	return out
+}
+
+func responseFromPB(in *pb.CompileResponse) *Response {
+	resp := &Response{
+		Objects: []ResponseItem{},
+		Warning: in.Warning,
+		Version: in.Version,
+		Error:   in.Error,
+		Rebuilt: in.Rebuilt,
+		Cached:  in.Cached,
+	}
+	for _, item := range in.Objects {
+		resp.Objects = append(resp.Objects, ResponseItem{
+			Objectname: item.Objectname,
+			Bytecode:   item.Bytecode,
+			ABI:        item.Abi,
+		})
+	}
+	return resp
+}
+
+func eventToPB(event CompileEvent) *pb.CompileEvent {
+	out := &pb.CompileEvent{
+		Type:     event.Type,
+		Include:  event.Include,
+		File:     event.File,
+		Imports:  event.Imports,
+		Severity: event.Severity,
+		Message:  event.Message,
+	}
+	if event.Response != nil {
+		out.Response = responseToPB(event.Response)
+	}
+	return out
+}
+
+func eventFromPB(in *pb.CompileEvent) CompileEvent {
+	event := CompileEvent{
+		Type:     in.Type,
+		Include:  in.Include,
+		File:     in.File,
+		Imports:  in.Imports,
+		Severity: in.Severity,
+		Message:  in.Message,
+	}
+	if in.Response != nil {
+		event.Response = responseFromPB(in.Response)
+	}
+	return event
+}
+
+// Client of the gRPC API of a compile server, configured by Client
+type GRPCClient struct {
+	conn   *grpc.ClientConn
+	client pb.CompilersClient
+}
+
+// bearer token sent with every call
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx netcontext.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// Connect to the gRPC API of the compile server at addr, host:port, over TLS
+// if secure
+func DialGRPC(addr string, secure bool) (*GRPCClient, error) {
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if secure {
+		tlsConfig, err := Client.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		pin, err := Client.pinnedCA()
+		if err != nil {
+			return nil, err
+		}
+		creds := credentials.NewTLS(tlsConfig)
+		if pin != nil {
+			creds = &pinnedCredentials{config: tlsConfig, pin: pin}
+		}
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	}
+	if Client.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials(Client.Token)))
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &GRPCClient{conn: conn, client: pb.NewCompilersClient(conn)}, nil
+}
+
+// Client transport credentials trusting servers by a pinned CA, verified by
+// pinnedClient as credentials.NewTLS has no way to
+type pinnedCredentials struct {
+	config *tls.Config
+	pin    []byte
+}
+
+func (c *pinnedCredentials) ClientHandshake(ctx netcontext.Context, addr string,
+	rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, err := pinnedClient(ctx, rawConn, c.config, addr, c.pin)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, credentials.TLSInfo{State: conn.(*tls.Conn).ConnectionState()}, nil
+}
+
+func (c *pinnedCredentials) ServerHandshake(net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, fmt.Errorf("pinned CA credentials are for clients only")
+}
+
+func (c *pinnedCredentials) Info() credentials.ProtocolInfo {
+	// as credentials.NewTLS reports
+	return credentials.ProtocolInfo{
+		SecurityProtocol: "tls",
+		SecurityVersion:  "1.2",
+		ServerName:       c.config.ServerName,
+	}
+}
+
+func (c *pinnedCredentials) Clone() credentials.TransportCredentials {
+	return &pinnedCredentials{config: c.config.Clone(), pin: c.pin}
+}
+
+func (c *pinnedCredentials) OverrideServerName(name string) error {
+	c.config.ServerName = name
+	return nil
+}
+
+func (c *GRPCClient) Close() error {
+	return c.conn.Close()
+}
+
+// the error a call failed with as a *ServerError, so that it can be tested
+// for with errors.Is as the errors of the HTTP client can
+func grpcServerError(err error) error {
+	if err == nil {
+		return nil
+	}
+	status, ok := grpcStatuses[grpc.Code(err)]
+	if !ok {
+		return err
+	}
+	return &ServerError{
+		StatusCode: status,
+		Code:       statusCodes[status],
+		Message:    grpc.ErrorDesc(err),
+	}
+}
+
+// the response of a compile, which is ErrCompileFailed should the compiler
+// have reported errors, as requestResponse does
+func grpcResponse(in *pb.CompileResponse) (*Response, error) {
+	resp := responseFromPB(in)
+	if resp.Error != "" {
+		err := &ServerError{
+			StatusCode: http.StatusUnprocessableEntity,
+			Code:       CodeCompileFailed,
+			Message:    resp.Error,
+		}
+		for _, diagnostic := range diagnostics(resp.Error, nil) {
+			err.Details = append(err.Details, diagnostic.Message)
+		}
+		return resp, err
+	}
+	return resp, nil
+}
+
+// Compile req. A failed compile is returned as both a Response carrying the
+// compiler's output and an error which is ErrCompileFailed.
+func (c *GRPCClient) Compile(ctx context.Context, req *definitions.Request) (*Response, error) {
+	resp, err := c.client.Compile(ctx, requestToPB(req))
+	if err != nil {
+		return nil, grpcServerError(err)
+	}
+	return grpcResponse(resp)
+}
+
+// Compile req, passing its progress to events as it is reported
+func (c *GRPCClient) CompileStream(ctx context.Context, req *definitions.Request,
+	events func(CompileEvent)) (*Response, error) {
+	stream, err := c.client.CompileStream(ctx, requestToPB(req))
+	if err != nil {
+		return nil, grpcServerError(err)
+	}
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return nil, &ServerError{
+				StatusCode: http.StatusInternalServerError,
+				Code:       CodeInternal,
+				Message:    "stream ended without a response",
+			}
+		} else if err != nil {
+			return nil, grpcServerError(err)
+		}
+		if events != nil {
+			events(eventFromPB(event))
+		}
+		if event.Type == EventResponse && event.Response != nil {
+			return grpcResponse(event.Response)
+		}
+	}
+}
+
+// Link the libraries of req into its binary
+func (c *GRPCClient) Link(ctx context.Context, req *definitions.BinaryRequest) (*BinaryResponse, error) {
+	resp, err := c.client.Link(ctx, &pb.LinkRequest{Binary: req.BinaryFile, Libraries: req.Libraries})
+	if err != nil {
+		return nil, grpcServerError(err)
+	}
+	return &BinaryResponse{Binary: resp.Binary, Error: resp.Error}, nil
+}
+
+// Languages and features the server supports
+func (c *GRPCClient) ListCompilers(ctx context.Context) (*CompilersResponse, error) {
+	resp, err := c.client.ListCompilers(ctx, &pb.ListCompilersRequest{})
+	if err != nil {
+		return nil, grpcServerError(err)
+	}
+	compilers := &CompilersResponse{
+		Compilers:   []CompilerInfo{},
+		Features:    resp.Features,
+		APIVersions: resp.ApiVersions,
+	}
+	for _, info := range resp.Compilers {
+		compilers.Compilers = append(compilers.Compilers, CompilerInfo{
+			Language:  info.Language,
+			Installed: info.Installed,
+			Version:   info.Version,
+			Options:   info.Options,
+		})
+	}
+	return compilers, nil
+}
@@ -0,0 +1,123 @@
+package perform
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/monax/compilers/definitions"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Serve the gRPC API of server on a local port and connect a client to it
+func withGRPCClient(t *testing.T, server *Server) (*GRPCClient, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := server.newGRPCServer(nil)
+	go srv.Serve(listener)
+	client, err := DialGRPC(listener.Addr().String(), false)
+	require.NoError(t, err)
+	return client, func() {
+		client.Close()
+		srv.Stop()
+	}
+}
+
+func TestGRPCCompile(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	client, stop := withGRPCClient(t, server)
+	defer stop()
+	ctx := context.Background()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "A", "contract A\n")
+	resp, err := client.Compile(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, resp.Objects, 1)
+	assert.Equal(t, "A", resp.Objects[0].Objectname)
+	assert.Equal(t, []string{"A"}, resp.Rebuilt)
+
+	addInclude(req, "B", "contract B\n")
+	var events []string
+	resp, err = client.CompileStream(ctx, req, func(event CompileEvent) {
+		events = append(events, event.Type)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"B"}, resp.Rebuilt)
+	assert.Contains(t, events, EventCacheHit)
+	assert.Contains(t, events, EventCompileStart)
+	assert.Equal(t, EventResponse, events[len(events)-1])
+
+	link, err := client.Link(ctx, &definitions.BinaryRequest{BinaryFile: "6060"})
+	require.NoError(t, err)
+	assert.Equal(t, "6060", link.Binary)
+
+	compilers, err := client.ListCompilers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, serverFeatures, compilers.Features)
+	assert.NotEmpty(t, compilers.Compilers)
+
+	// a failed compile carries the compiler's output
+	addInclude(req, "C", "contract C { boom }\n")
+	resp, err = client.Compile(ctx, req)
+	assert.True(t, errors.Is(err, ErrCompileFailed), "%v", err)
+	require.NotNil(t, resp)
+	assert.Contains(t, resp.Error, "Error: boom")
+
+	// as do invalid requests
+	req.Language = "nope"
+	_, err = client.Compile(ctx, req)
+	assert.True(t, errors.Is(err, ErrBadRequest), "%v", err)
+}
+
+func TestGRPCAuthorize(t *testing.T) {
+	server, closeServer := withTestServer()
+	defer closeServer()
+	dir, err := ioutil.TempDir("", "tokens")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := path.Join(dir, "tokens")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("compiler compile\n"), 0600))
+	server.tokens, err = loadTokens(tokenFile)
+	require.NoError(t, err)
+	defer func() { Client.Token = "" }()
+	ctx := context.Background()
+
+	client, stop := withGRPCClient(t, server)
+	_, err = client.Link(ctx, &definitions.BinaryRequest{})
+	assert.True(t, errors.Is(err, ErrUnauthorized), "%v", err)
+	// listing compilers is public
+	_, err = client.ListCompilers(ctx)
+	assert.NoError(t, err)
+	stop()
+
+	Client.Token = "compiler"
+	client, stop = withGRPCClient(t, server)
+	defer stop()
+	_, err = client.Link(ctx, &definitions.BinaryRequest{})
+	assert.True(t, errors.Is(err, ErrForbidden), "%v", err)
+}
+
+func TestStartServerServesGRPC(t *testing.T) {
+	srv, err := StartServer(context.Background(), ServerConfig{AddrInsecure: ":9099", AddrGRPC: ":9097"})
+	require.NoError(t, err)
+	client, err := DialGRPC("localhost:9097", false)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.ListCompilers(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, srv.Close())
+	assertShutdown(t, srv)
+}
@@ -0,0 +1,58 @@
+package perform
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/monax/compilers/definitions"
+)
+
+// Map each include of a request to the includes it imports. Imports in
+// scripts have been replaced by the names of the includes they refer to, so
+// an include imports every other include whose name appears in its script.
+func importGraph(req *definitions.Request) map[string][]string {
+	graph := make(map[string][]string)
+	for name, include := range req.Includes {
+		for imported := range req.Includes {
+			if imported != name && bytes.Contains(include.Script, []byte(imported)) {
+				graph[name] = append(graph[name], imported)
+			}
+		}
+		sort.Strings(graph[name])
+	}
+	return graph
+}
+
+// Map each include of a request to the includes which import it
+func importers(req *definitions.Request) map[string][]string {
+	graph := make(map[string][]string)
+	for name, imports := range importGraph(req) {
+		for _, imported := range imports {
+			graph[imported] = append(graph[imported], name)
+		}
+	}
+	return graph
+}
+
+// The named includes along with every include which transitively imports
+// one of them, sorted
+func dependents(req *definitions.Request, names []string) []string {
+	graph := importers(req)
+	seen := make(map[string]bool)
+	queue := append([]string{}, names...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		queue = append(queue, graph[name]...)
+	}
+	result := make([]string, 0, len(seen))
+	for name := range seen {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
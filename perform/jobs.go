@@ -0,0 +1,300 @@
+package perform
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monax/compilers/definitions"
+
+	"github.com/monax/cli/log"
+)
+
+// Compile jobs let clients submit a compile and poll for its result rather
+// than hold a connection open for as long as the compile takes.
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+const defaultJobRetention = time.Hour
+
+// Compile job as reported by the jobs API. A failed job carries a Response if
+// the compiler ran and reported errors, otherwise only Error.
+type Job struct {
+	ID       string    `json:"id"`
+	Status   JobStatus `json:"status"`
+	Response *Response `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// error code of a failed job, as in ErrorBody
+	Code     string     `json:"code,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+type job struct {
+	Job
+	// client which submitted the job, see jobOwner
+	owner  string
+	cancel context.CancelFunc
+	// whether the job was cancelled, recorded as its outcome once its
+	// compile has returned
+	cancelled bool
+	// closed once the job has finished
+	done chan struct{}
+}
+
+// Jobs known to the server, finished jobs are forgotten after the retention
+// period
+type jobStore struct {
+	mu        sync.Mutex
+	jobs      map[string]*job
+	retention time.Duration
+	running   sync.WaitGroup
+}
+
+func newJobStore(retention time.Duration) *jobStore {
+	return &jobStore{
+		jobs:      make(map[string]*job),
+		retention: retention,
+	}
+}
+
+// Start compiling req on pool in the background for owner, with the values
+// but not the cancellation of ctx. Fails with errQueueFull, rather than accept
+// a job bound to fail, if the pool is full or has no room for more unfinished
+// jobs.
+func (s *jobStore) submit(ctx context.Context, pool *workerPool, owner string, req *definitions.Request) (Job, error) {
+	s.mu.Lock()
+	s.prune()
+	if capacity := pool.capacity(); pool.full() || capacity > 0 && s.unfinished() >= capacity {
+		s.mu.Unlock()
+		return Job{}, errQueueFull
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	j := &job{
+		Job: Job{
+			ID:      newJobID(),
+			Status:  JobQueued,
+			Created: time.Now().UTC(),
+		},
+		owner:  owner,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	s.jobs[j.ID] = j
+	submitted := j.Job
+	s.mu.Unlock()
+
+	log.WithField("job", j.ID).Debug("Submitted compile job")
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer cancel()
+		ctx = withEventSink(ctx, func(event CompileEvent) {
+			if event.Type != EventCompileStart {
+				return
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if j.Status == JobQueued {
+				j.Status = JobRunning
+			}
+		})
+		resp, err := serveCompile(ctx, pool, req)
+		s.finish(j, resp, err)
+	}()
+	return submitted, nil
+}
+
+func (s *jobStore) finish(j *job, resp *Response, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer close(j.done)
+	finished := time.Now().UTC()
+	j.Finished = &finished
+	j.Response = resp
+	switch {
+	case j.cancelled:
+		j.Response = nil
+		j.Status = JobFailed
+		j.Error = "job cancelled"
+	case err != nil:
+		j.Status = JobFailed
+		j.Error = err.Error()
+		_, j.Code = errorStatus(err)
+	case resp.Error != "":
+		j.Status = JobFailed
+		j.Error = resp.Error
+		j.Code = CodeCompileFailed
+	default:
+		j.Status = JobDone
+	}
+	log.WithFields(log.Fields{
+		"job":    j.ID,
+		"status": j.Status,
+	}).Debug("Compile job finished")
+}
+
+func (s *jobStore) get(id, owner string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	j, ok := s.lookup(id, owner)
+	if !ok {
+		return Job{}, false
+	}
+	return j.Job, true
+}
+
+// Cancel an unfinished job and wait for it to stop, or for ctx to be done
+// first, or forget a finished one
+func (s *jobStore) cancel(ctx context.Context, id, owner string) (Job, bool) {
+	s.mu.Lock()
+	j, ok := s.lookup(id, owner)
+	if !ok {
+		s.mu.Unlock()
+		return Job{}, false
+	}
+	if j.Finished != nil {
+		delete(s.jobs, id)
+		s.mu.Unlock()
+		return j.Job, true
+	}
+	s.stop(j)
+	s.mu.Unlock()
+
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return j.Job, true
+}
+
+// the job with id if it belongs to owner, other clients' jobs being as good
+// as missing. Must be called with the lock held.
+func (s *jobStore) lookup(id, owner string) (*job, bool) {
+	j, ok := s.jobs[id]
+	if !ok || j.owner != owner {
+		return nil, false
+	}
+	return j, true
+}
+
+// cancel the compile of an unfinished job, which stays unfinished until the
+// compile has returned. Must be called with the lock held.
+func (s *jobStore) stop(j *job) {
+	j.cancelled = true
+	j.cancel()
+}
+
+// number of jobs yet to finish, must be called with the lock held
+func (s *jobStore) unfinished() int {
+	n := 0
+	for _, j := range s.jobs {
+		if j.Finished == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// forget jobs which finished longer ago than the retention period, must be
+// called with the lock held
+func (s *jobStore) prune() {
+	for id, j := range s.jobs {
+		if j.Finished != nil && time.Since(*j.Finished) > s.retention {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// Wait for running jobs to finish. If ctx is done first the jobs still
+// running are cancelled, and waited for, and false is returned.
+func (s *jobStore) drain(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		if j.Finished == nil {
+			s.stop(j)
+		}
+	}
+	s.mu.Unlock()
+	<-done
+	return false
+}
+
+func newJobID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Jobs API handler
+// POST /jobs submits a compile, GET /jobs/{id} reports on it and
+// DELETE /jobs/{id} cancels it, answering once its compile has stopped. Jobs
+// are only reported on to, and cancelled by, the client which submitted them.
+func (s *Server) JobsHandler(w http.ResponseWriter, r *http.Request) {
+	s.serveJobs(w, r, "/jobs", writeJob)
+}
+
+// serve the jobs API under prefix, answering with jobs written by writeJob
+func (s *Server) serveJobs(w http.ResponseWriter, r *http.Request, prefix string,
+	writeJob func(http.ResponseWriter, int, Job)) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	owner := s.jobOwner(r)
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		req := s.readCompileRequest(w, r)
+		if req == nil {
+			return
+		}
+		j, err := s.jobs.submit(r.Context(), s.pool, owner, req)
+		if err != nil {
+			s.turnAway(w, err)
+			return
+		}
+		writeJob(w, http.StatusAccepted, j)
+	case id != "" && r.Method == http.MethodGet:
+		j, ok := s.jobs.get(id, owner)
+		if !ok {
+			writeError(w, http.StatusNotFound, CodeNotFound, "no such job "+id)
+			return
+		}
+		writeJob(w, http.StatusOK, j)
+	case id != "" && r.Method == http.MethodDelete:
+		j, ok := s.jobs.cancel(r.Context(), id, owner)
+		if !ok {
+			writeError(w, http.StatusNotFound, CodeNotFound, "no such job "+id)
+			return
+		}
+		writeJob(w, http.StatusOK, j)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeJob(w http.ResponseWriter, status int, j Job) {
+	writeJSON(w, status, &j)
+}
@@ -0,0 +1,308 @@
+package perform
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileJob(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	testServer := httptest.NewServer(http.HandlerFunc(server.JobsHandler))
+	defer testServer.Close()
+	interval := JobPollInterval
+	JobPollInterval = 10 * time.Millisecond
+	defer func() { JobPollInterval = interval }()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "J", "contract J\n")
+	resp, err := requestJobResponse(context.Background(), req, serverAPI{base: testServer.URL})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Error)
+	assert.Equal(t, []string{"J"}, resp.Rebuilt)
+}
+
+func TestCancelCompileJob(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	// keep the job queued behind a busy worker
+	server.pool = newWorkerPool(1, 1, 0)
+	release := make(chan struct{})
+	defer close(release)
+	running := make(chan struct{})
+	go server.pool.do(context.Background(), func() {
+		close(running)
+		<-release
+	})
+	<-running
+	testServer := httptest.NewServer(http.HandlerFunc(server.JobsHandler))
+	defer testServer.Close()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "K", "contract K\n")
+	job := new(Job)
+	require.NoError(t, doJSON(context.Background(), "POST", testServer.URL+"/jobs", req, job))
+	require.NoError(t, doJSON(context.Background(), "GET", testServer.URL+"/jobs/"+job.ID, nil, job))
+	assert.Equal(t, JobQueued, job.Status)
+
+	require.NoError(t, doJSON(context.Background(), "DELETE", testServer.URL+"/jobs/"+job.ID, nil, job))
+	assert.Equal(t, JobFailed, job.Status)
+	require.NoError(t, doJSON(context.Background(), "GET", testServer.URL+"/jobs/"+job.ID, nil, job))
+	assert.Equal(t, JobFailed, job.Status)
+	assert.Equal(t, "job cancelled", job.Error)
+
+	err := doJSON(context.Background(), "GET", testServer.URL+"/jobs/unknown", nil, job)
+	assert.True(t, errors.Is(err, ErrNotFound), "%v", err)
+}
+
+func TestCompileJobOwner(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	dir, err := ioutil.TempDir("", "tokens")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := path.Join(dir, "tokens")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("alice compile\nbob compile\n"), 0600))
+	server.tokens, err = loadTokens(tokenFile)
+	require.NoError(t, err)
+	testServer := httptest.NewServer(server.authorize(ScopeCompile, server.JobsHandler))
+	defer testServer.Close()
+	defer func() { Client.Token = "" }()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "O", "contract O\n")
+	Client.Token = "alice"
+	job := new(Job)
+	require.NoError(t, doJSON(context.Background(), "POST", testServer.URL+"/jobs", req, job))
+	require.NoError(t, doJSON(context.Background(), "GET", testServer.URL+"/jobs/"+job.ID, nil, new(Job)))
+
+	// other clients can neither see nor cancel the job
+	Client.Token = "bob"
+	err = doJSON(context.Background(), "GET", testServer.URL+"/jobs/"+job.ID, nil, new(Job))
+	assert.True(t, errors.Is(err, ErrNotFound), "%v", err)
+	err = doJSON(context.Background(), "DELETE", testServer.URL+"/jobs/"+job.ID, nil, new(Job))
+	assert.True(t, errors.Is(err, ErrNotFound), "%v", err)
+
+	Client.Token = "alice"
+	require.NoError(t, doJSON(context.Background(), "DELETE", testServer.URL+"/jobs/"+job.ID, nil, new(Job)))
+}
+
+func TestCompileJobCertificateOwner(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+
+	// clients behind one address are told apart by their certificates
+	serve := func(method, target, cn string, body []byte) *httptest.ResponseRecorder {
+		r := withClientCertificate(httptest.NewRequest(method, target, bytes.NewReader(body)), cn)
+		r.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		server.JobsHandler(w, r)
+		return w
+	}
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "P", "contract P\n")
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+	w := serve("POST", "/jobs", "alice", body)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	job := new(Job)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), job))
+
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/jobs/"+job.ID, "bob", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/jobs/"+job.ID, "bob", nil).Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "/jobs/"+job.ID, "alice", nil).Code)
+	assert.Equal(t, http.StatusOK, serve("DELETE", "/jobs/"+job.ID, "alice", nil).Code)
+}
+
+// r as if made over TLS with a verified client certificate for cn
+func withClientCertificate(r *http.Request, cn string) *http.Request {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return r
+}
+
+func TestRequestCompileJobCancelled(t *testing.T) {
+	_, cleanup := withFakeCompiler(t, "exec sleep 10")
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	testServer := httptest.NewServer(http.HandlerFunc(server.JobsHandler))
+	defer testServer.Close()
+	interval := JobPollInterval
+	JobPollInterval = 10 * time.Millisecond
+	defer func() { JobPollInterval = interval }()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "L", "contract L\n")
+	cancelled := cancelledJobs(server.jobs)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := requestJobResponse(ctx, req, serverAPI{base: testServer.URL})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	// the client cancelled the job on its way out
+	assert.Equal(t, cancelled+1, cancelledJobs(server.jobs))
+}
+
+func TestCancelledJobRunsUntilStopped(t *testing.T) {
+	// the compiler's child keeps its output open for a while after the
+	// compiler is killed
+	_, cleanup := withFakeCompiler(t, "sleep 10")
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "Q", "contract Q\n")
+	submitted, err := server.jobs.submit(context.Background(), server.pool, "", req)
+	require.NoError(t, err)
+	for {
+		j, _ := server.jobs.get(submitted.ID, "")
+		if j.Status == JobRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// cancelling without waiting leaves the job counted against the pool,
+	// and cancelling it again does not forget it
+	gaveUp, giveUp := context.WithCancel(context.Background())
+	giveUp()
+	for i := 0; i < 2; i++ {
+		j, ok := server.jobs.cancel(gaveUp, submitted.ID, "")
+		require.True(t, ok)
+		assert.Equal(t, JobRunning, j.Status)
+	}
+	server.jobs.mu.Lock()
+	unfinished := server.jobs.unfinished()
+	server.jobs.mu.Unlock()
+	assert.Equal(t, 1, unfinished)
+
+	// until its compile has returned
+	j, ok := server.jobs.cancel(context.Background(), submitted.ID, "")
+	require.True(t, ok)
+	assert.Equal(t, JobFailed, j.Status)
+	assert.Equal(t, "job cancelled", j.Error)
+}
+
+func cancelledJobs(jobs *jobStore) int {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	n := 0
+	for _, j := range jobs.jobs {
+		if j.Error == "job cancelled" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCompileJobTurnedAway(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	// a pool with no room to queue and its only worker busy
+	server.pool = newWorkerPool(1, 0, time.Second)
+	release := make(chan struct{})
+	defer close(release)
+	running := make(chan struct{})
+	go server.pool.do(context.Background(), func() {
+		close(running)
+		<-release
+	})
+	<-running
+	testServer := httptest.NewServer(http.HandlerFunc(server.JobsHandler))
+	defer testServer.Close()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "M", "contract M\n")
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+	resp, err := http.Post(testServer.URL+"/jobs", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
+
+func TestCoalescedJobsRun(t *testing.T) {
+	_, cleanup := withFakeCompiler(t, "sleep 1")
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "N", "contract N\n")
+	first, err := server.jobs.submit(context.Background(), server.pool, "", req)
+	require.NoError(t, err)
+	second, err := server.jobs.submit(context.Background(), server.pool, "", req)
+	require.NoError(t, err)
+
+	// both jobs report the compile they share as running
+	deadline := time.Now().Add(time.Second)
+	for _, id := range []string{first.ID, second.ID} {
+		for {
+			j, ok := server.jobs.get(id, "")
+			require.True(t, ok)
+			if j.Status == JobRunning {
+				break
+			}
+			require.Equal(t, JobQueued, j.Status)
+			require.True(t, time.Now().Before(deadline), "job %s still queued", id)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	require.True(t, server.jobs.drain(context.Background()))
+	for _, id := range []string{first.ID, second.ID} {
+		j, _ := server.jobs.get(id, "")
+		assert.Equal(t, JobDone, j.Status)
+	}
+}
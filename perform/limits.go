@@ -0,0 +1,334 @@
+package perform
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monax/cli/log"
+)
+
+// Per client limits on what the server does for it. Rates are sustained
+// amounts per minute, each of which may be used up in a burst; quotas are
+// totals per UTC day. Zero disables a limit.
+type LimitConfig struct {
+	RequestsPerMinute float64
+	BytesPerMinute    float64
+	CPUPerMinute      time.Duration
+	DailyRequests     int64
+	DailyBytes        int64
+	DailyCPU          time.Duration
+}
+
+// whether any limit is set
+func (c LimitConfig) enabled() bool {
+	return c != LimitConfig{}
+}
+
+// What a client has used today, reported by /usage
+type ClientUsage struct {
+	// requests are limited by certificate subject, then API token, then IP
+	Client     string  `json:"client"`
+	Day        string  `json:"day"`
+	Requests   int64   `json:"requests"`
+	Bytes      int64   `json:"bytes"`
+	CPUSeconds float64 `json:"cpuSeconds"`
+	// daily quotas, zero where there is none
+	Quota UsageQuota `json:"quota"`
+}
+
+type UsageQuota struct {
+	Requests   int64   `json:"requests"`
+	Bytes      int64   `json:"bytes"`
+	CPUSeconds float64 `json:"cpuSeconds"`
+}
+
+// Token buckets and daily usage of every client seen recently
+type rateLimiter struct {
+	conf      LimitConfig
+	mu        sync.Mutex
+	clients   map[string]*clientLimits
+	lastPrune time.Time
+}
+
+type clientLimits struct {
+	requests bucket
+	bytes    bucket
+	cpu      bucket // in seconds
+	usage    ClientUsage
+	lastSeen time.Time
+}
+
+// A token bucket holding up to a minute's worth of its rate, which is spent
+// into debt by charges made after the fact
+type bucket struct {
+	level float64
+	last  time.Time
+}
+
+func newRateLimiter(conf LimitConfig) *rateLimiter {
+	return &rateLimiter{
+		conf:    conf,
+		clients: make(map[string]*clientLimits),
+	}
+}
+
+// top the bucket up for the time passed since it was last filled
+func (b *bucket) fill(now time.Time, perMinute float64) {
+	if b.last.IsZero() {
+		b.level = perMinute
+	} else {
+		b.level = math.Min(perMinute, b.level+now.Sub(b.last).Minutes()*perMinute)
+	}
+	b.last = now
+}
+
+// how long until the bucket holds want
+func (b *bucket) wait(want, perMinute float64) time.Duration {
+	return time.Duration((want - b.level) / perMinute * float64(time.Minute))
+}
+
+func day(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+func untilTomorrow(now time.Time) time.Duration {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+// the limits of client, with its buckets filled and usage reset on a new day
+func (l *rateLimiter) client(key string, now time.Time) *clientLimits {
+	if now.Sub(l.lastPrune) > time.Minute {
+		l.prune(now)
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientLimits{usage: ClientUsage{Client: key}}
+		l.clients[key] = c
+	}
+	if today := day(now); c.usage.Day != today {
+		c.usage = ClientUsage{Client: key, Day: today}
+	}
+	c.requests.fill(now, l.conf.RequestsPerMinute)
+	c.bytes.fill(now, l.conf.BytesPerMinute)
+	c.cpu.fill(now, l.conf.CPUPerMinute.Seconds())
+	c.lastSeen = now
+	return c
+}
+
+// forget clients whose buckets have refilled and whose usage no longer counts
+// towards a quota
+func (l *rateLimiter) prune(now time.Time) {
+	quotas := l.conf.DailyRequests > 0 || l.conf.DailyBytes > 0 || l.conf.DailyCPU > 0
+	for key, c := range l.clients {
+		if now.Sub(c.lastSeen) > time.Minute && (!quotas || c.usage.Day != day(now)) {
+			delete(l.clients, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// Count a request of client unless it is over a limit, in which case the
+// reason and how long until it may retry are returned
+func (l *rateLimiter) admit(key string, now time.Time) (string, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.client(key, now)
+	if reason, wait := l.over(c, now); reason != "" {
+		return reason, wait
+	}
+	c.requests.level--
+	c.usage.Requests++
+	return "", 0
+}
+
+// As admit, but without counting the request
+func (l *rateLimiter) check(key string, now time.Time) (string, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.over(l.client(key, now), now)
+}
+
+// the limit c is over and how long until it may retry, must be called with
+// the lock held
+func (l *rateLimiter) over(c *clientLimits, now time.Time) (string, time.Duration) {
+	conf := l.conf
+
+	switch {
+	case conf.DailyRequests > 0 && c.usage.Requests >= conf.DailyRequests:
+		return "daily request quota exhausted", untilTomorrow(now)
+	case conf.DailyBytes > 0 && c.usage.Bytes >= conf.DailyBytes:
+		return "daily compiled bytes quota exhausted", untilTomorrow(now)
+	case conf.DailyCPU > 0 && c.usage.CPUSeconds >= conf.DailyCPU.Seconds():
+		return "daily compile CPU quota exhausted", untilTomorrow(now)
+	case conf.RequestsPerMinute > 0 && c.requests.level < 1:
+		return "request rate limit exceeded", c.requests.wait(1, conf.RequestsPerMinute)
+	case conf.BytesPerMinute > 0 && c.bytes.level <= 0:
+		return "compiled bytes rate limit exceeded", c.bytes.wait(1, conf.BytesPerMinute)
+	case conf.CPUPerMinute > 0 && c.cpu.level <= 0:
+		return "compile CPU rate limit exceeded", c.cpu.wait(0.001, conf.CPUPerMinute.Seconds())
+	}
+	return "", 0
+}
+
+// charge client for bytes it sent to be compiled
+func (l *rateLimiter) chargeBytes(key string, n uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.client(key, time.Now())
+	c.bytes.level -= float64(n)
+	c.usage.Bytes += int64(n)
+}
+
+// charge client for CPU time its compiles used
+func (l *rateLimiter) chargeCPU(key string, cpu time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.client(key, time.Now())
+	c.cpu.level -= cpu.Seconds()
+	c.usage.CPUSeconds += cpu.Seconds()
+}
+
+func (l *rateLimiter) usage(key string) ClientUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	usage := l.client(key, time.Now()).usage
+	usage.Quota = UsageQuota{
+		Requests:   l.conf.DailyRequests,
+		Bytes:      l.conf.DailyBytes,
+		CPUSeconds: l.conf.DailyCPU.Seconds(),
+	}
+	return usage
+}
+
+// The client requests are limited as: the subject of its verified
+// certificate, else its API token when the server checks tokens, otherwise
+// its IP
+func (s *Server) clientKey(r *http.Request) string {
+	return s.clientKeyOf(clientCertificate(r), bearerToken(r), r.RemoteAddr)
+}
+
+func (s *Server) clientKeyOf(cert *x509.Certificate, token, remoteAddr string) string {
+	if cert != nil {
+		return "cn:" + cert.Subject.CommonName
+	}
+	if token != "" && s.tokens != nil {
+		return tokenID(token)
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// identifies a token without revealing it
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:8])
+}
+
+// The client owning the jobs a request submits: its certificate subject, or
+// its API token when the server checks tokens. Empty when it has neither, in
+// which case knowing the random id of a job is enough to reach it.
+func (s *Server) jobOwner(r *http.Request) string {
+	cert := clientCertificate(r)
+	if cert == nil && s.tokens == nil {
+		return ""
+	}
+	return s.clientKeyOf(cert, bearerToken(r), r.RemoteAddr)
+}
+
+type cpuChargeKey struct{}
+
+// Charge the CPU time of compilers run with ctx to charge
+func withCPUCharge(ctx context.Context, charge func(time.Duration)) context.Context {
+	return context.WithValue(ctx, cpuChargeKey{}, charge)
+}
+
+// the CPU charge of ctx, if it has one
+func cpuCharge(ctx context.Context) (func(time.Duration), bool) {
+	charge, ok := ctx.Value(cpuChargeKey{}).(func(time.Duration))
+	return charge, ok
+}
+
+func chargeCPU(ctx context.Context, cpu time.Duration) {
+	if charge, ok := cpuCharge(ctx); ok {
+		charge(cpu)
+	}
+}
+
+// Turn away requests to handler from clients over their limits with 429 Too
+// Many Requests, and charge the rest for the bytes they send and the CPU time
+// of the compiles they cause. Reads, such as polling a job, are not limited.
+// Streaming requests are charged for CPU time only.
+func (s *Server) limit(handler http.HandlerFunc) http.HandlerFunc {
+	return s.limitRequests(handler, true)
+}
+
+// As limit, but without counting the request against the client's request
+// rate and quota. For requests, such as negotiating a compile, which go
+// ahead of a request that is counted.
+func (s *Server) limitUncounted(handler http.HandlerFunc) http.HandlerFunc {
+	return s.limitRequests(handler, false)
+}
+
+func (s *Server) limitRequests(handler http.HandlerFunc, count bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter := s.limits
+		if limiter == nil || r.Method == http.MethodGet && !isWebSocket(r) || r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+		key := s.clientKey(r)
+		admit := limiter.admit
+		if !count {
+			admit = limiter.check
+		}
+		if reason, wait := admit(key, time.Now()); reason != "" {
+			log.WithField("client", key).Warnf("Turning request away: %s", reason)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, CodeRateLimited, reason)
+			return
+		}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		ctx := withCPUCharge(r.Context(), func(cpu time.Duration) {
+			limiter.chargeCPU(key, cpu)
+		})
+		handler(w, r.WithContext(ctx))
+		limiter.chargeBytes(key, body.n)
+	}
+}
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// Usage of the calling client today along with its quotas
+func (s *Server) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if s.limits == nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, "the server does not limit clients")
+		return
+	}
+	usage := s.limits.usage(s.clientKey(r))
+	writeJSON(w, http.StatusOK, &usage)
+}
+
+// Ask the server at url, the compile route, what the client has used today
+func RequestUsage(url string) (*ClientUsage, error) {
+	usage := new(ClientUsage)
+	if err := doJSON(context.Background(), "GET", routeURL(url, "usage"), nil, usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
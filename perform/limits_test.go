@@ -0,0 +1,148 @@
+package perform
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimits(t *testing.T) {
+	limiter := newRateLimiter(LimitConfig{RequestsPerMinute: 2, BytesPerMinute: 100})
+	now := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		reason, _ := limiter.admit("ip:a", now)
+		assert.Empty(t, reason)
+	}
+	reason, wait := limiter.admit("ip:a", now)
+	assert.Equal(t, "request rate limit exceeded", reason)
+	assert.Equal(t, 30*time.Second, wait)
+	// clients are limited independently
+	reason, _ = limiter.admit("ip:b", now)
+	assert.Empty(t, reason)
+
+	now = now.Add(wait)
+	reason, _ = limiter.admit("ip:a", now)
+	assert.Empty(t, reason)
+
+	limiter.clients["ip:b"].bytes.level -= 150
+	reason, wait = limiter.admit("ip:b", now)
+	assert.Equal(t, "compiled bytes rate limit exceeded", reason)
+	assert.True(t, wait > 0)
+}
+
+func TestDailyQuotas(t *testing.T) {
+	limiter := newRateLimiter(LimitConfig{DailyRequests: 2, DailyCPU: time.Second})
+	now := time.Date(2017, 5, 1, 18, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		reason, _ := limiter.admit("ip:a", now)
+		assert.Empty(t, reason)
+	}
+	reason, wait := limiter.admit("ip:a", now)
+	assert.Equal(t, "daily request quota exhausted", reason)
+	assert.Equal(t, 6*time.Hour, wait)
+
+	// quotas reset at midnight UTC
+	now = now.Add(wait)
+	reason, _ = limiter.admit("ip:a", now)
+	assert.Empty(t, reason)
+	limiter.clients["ip:a"].usage.CPUSeconds = 1.5
+	reason, _ = limiter.admit("ip:a", now)
+	assert.Equal(t, "daily compile CPU quota exhausted", reason)
+}
+
+func TestLimitHandler(t *testing.T) {
+	server, closeServer := withTestServer()
+	defer closeServer()
+	server.limits = newRateLimiter(LimitConfig{RequestsPerMinute: 1, DailyBytes: 1000})
+
+	handled := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.limit(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+		ioutil.ReadAll(r.Body)
+		chargeCPU(r.Context(), 250*time.Millisecond)
+		w.Write([]byte("{}"))
+	}))
+	mux.HandleFunc("/usage", server.UsageHandler)
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	resp, err := http.Post(testServer.URL, "application/json", strings.NewReader(`{"language":"sol"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Post(testServer.URL, "application/json", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	assert.Equal(t, 1, handled)
+
+	usage, err := RequestUsage(testServer.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "ip:127.0.0.1", usage.Client)
+	assert.Equal(t, int64(1), usage.Requests)
+	assert.Equal(t, int64(len(`{"language":"sol"}`)), usage.Bytes)
+	assert.Equal(t, 0.25, usage.CPUSeconds)
+	assert.Equal(t, int64(1000), usage.Quota.Bytes)
+}
+
+func TestLimitByCertificate(t *testing.T) {
+	server, closeServer := withTestServer()
+	defer closeServer()
+	server.limits = newRateLimiter(LimitConfig{RequestsPerMinute: 1})
+	handler := server.limit(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+
+	// clients with certificates are limited by subject, not by address
+	post := func(cn string) int {
+		r := withClientCertificate(httptest.NewRequest("POST", "/", strings.NewReader(`{}`)), cn)
+		r.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, post("alice"))
+	assert.Equal(t, http.StatusOK, post("bob"))
+	assert.Equal(t, http.StatusTooManyRequests, post("alice"))
+	assert.NotNil(t, server.limits.clients["cn:alice"])
+	assert.Nil(t, server.limits.clients["ip:10.0.0.1"])
+}
+
+func TestLimitUncounted(t *testing.T) {
+	server, closeServer := withTestServer()
+	defer closeServer()
+	server.limits = newRateLimiter(LimitConfig{RequestsPerMinute: 1})
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.limit(ok))
+	mux.HandleFunc("/negotiate", server.limitUncounted(ok))
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	// negotiating leaves the one request a minute for the compile
+	post := func(route string) int {
+		resp, err := http.Post(testServer.URL+route, "application/json", strings.NewReader(`{}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, post("/negotiate"))
+	assert.Equal(t, http.StatusOK, post("/negotiate"))
+	assert.Equal(t, http.StatusOK, post("/"))
+	// but clients over a limit are still turned away
+	assert.Equal(t, http.StatusTooManyRequests, post("/negotiate"))
+}
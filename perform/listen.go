@@ -0,0 +1,97 @@
+package perform
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/monax/cli/log"
+)
+
+const (
+	// prefix of the addresses of Unix domain sockets, as in ServerConfig.Listen
+	// and ClientConfig.Socket
+	UnixPrefix = "unix:"
+	// address of the sockets passed by systemd socket activation
+	SystemdListen = "systemd"
+	// permissions of Unix domain sockets unless ServerConfig.SocketMode is set
+	DefaultSocketMode os.FileMode = 0660
+)
+
+// the first file descriptor passed by systemd, following stdin, stdout and
+// stderr
+const systemdFirstFD = 3
+
+// Listen on addr, which is either a Unix domain socket prefixed with
+// UnixPrefix, created with permissions mode, or SystemdListen for the sockets
+// systemd passed
+func listen(addr string, mode os.FileMode) ([]net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, UnixPrefix):
+		listener, err := listenUnix(strings.TrimPrefix(addr, UnixPrefix), mode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	case addr == SystemdListen:
+		return systemdListeners()
+	}
+	return nil, fmt.Errorf("unknown address %q, expected %s<path> or %s", addr, UnixPrefix, SystemdListen)
+}
+
+// Listen on a Unix domain socket at path, replacing the socket of a server
+// which did not remove it when it stopped
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		log.WithField("socket", path).Warn("Removing stale socket")
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// The sockets passed by systemd socket activation, see sd_listen_fds(3).
+// The variables passing them are unset so that compilers do not inherit them.
+func systemdListeners() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("no sockets were passed by systemd")
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	var listeners netListeners
+	for fd := systemdFirstFD; fd < systemdFirstFD+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			listeners.Close()
+			return nil, fmt.Errorf("Could not use socket %d passed by systemd: %s", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,63 @@
+package perform
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "compilers.sock")
+	defer func() { Client = ClientConfig{} }()
+
+	// the socket of a server which did not clean up is replaced
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv, err := StartServer(context.Background(), ServerConfig{
+		Listen:     []string{UnixPrefix + socket},
+		SocketMode: 0600,
+	})
+	require.NoError(t, err)
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	Client = ClientConfig{Socket: UnixPrefix + socket}
+	version := new(VersionResponse)
+	require.NoError(t, doJSON(context.Background(), "GET", "http://localhost/version", nil, version))
+	assert.NotEmpty(t, version.Version)
+
+	// but not that of a running one
+	_, err = StartServer(context.Background(), ServerConfig{Listen: []string{UnixPrefix + socket}})
+	assert.Error(t, err)
+
+	assert.NoError(t, srv.Close())
+	assertShutdown(t, srv)
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err), "socket left behind: %v", err)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	_, err := listen(SystemdListen, DefaultSocketMode)
+	assert.Error(t, err, "sockets passed to another process")
+	// which are not left for compilers to inherit
+	assert.Empty(t, os.Getenv("LISTEN_FDS"))
+
+	_, err = listen("tcp:localhost:9099", DefaultSocketMode)
+	assert.Error(t, err)
+}
@@ -0,0 +1,249 @@
+package perform
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/monax/cli/log"
+)
+
+// Upper bounds in seconds of the compile latency histogram buckets
+var compileBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Counters exposed on /metrics in the Prometheus text format
+type serverMetrics struct {
+	mu        sync.Mutex
+	requests  map[[2]string]uint64
+	compiles  map[[2]string]*histogram
+	failures  map[string]uint64
+	bytesIn   uint64
+	bytesOut  uint64
+	cacheHits uint64
+	cacheMiss uint64
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+var metrics = &serverMetrics{
+	requests: make(map[[2]string]uint64),
+	compiles: make(map[[2]string]*histogram),
+	failures: make(map[string]uint64),
+}
+
+// count a request to route answered with status code
+func (m *serverMetrics) request(route string, code int, in, out uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[2]string{route, strconv.Itoa(code)}]++
+	m.bytesIn += in
+	m.bytesOut += out
+}
+
+// record how long a compile with a language's compiler took
+func (m *serverMetrics) compiled(lang, version string, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{lang, version}
+	h, ok := m.compiles[key]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(compileBuckets))}
+		m.compiles[key] = h
+	}
+	seconds := took.Seconds()
+	for i, bound := range compileBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// count a compiler which could not be run, rather than one which reported
+// errors in what it compiled
+func (m *serverMetrics) compilerFailed(lang string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[lang]++
+}
+
+// count the includes of a request found in the cache and those which were
+// not. Each request is counted once, by the server answering it with objects.
+func (m *serverMetrics) cacheLookups(hits, misses int) {
+	atomic.AddUint64(&m.cacheHits, uint64(hits))
+	atomic.AddUint64(&m.cacheMiss, uint64(misses))
+}
+
+// Write every metric in the Prometheus text exposition format, along with the
+// depth of the queue of pool
+func (m *serverMetrics) writeTo(w io.Writer, pool *workerPool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP compilers_http_requests_total Requests served by route and status code.")
+	fmt.Fprintln(w, "# TYPE compilers_http_requests_total counter")
+	var requestKeys [][2]string
+	for key := range m.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		return requestKeys[i][0]+" "+requestKeys[i][1] < requestKeys[j][0]+" "+requestKeys[j][1]
+	})
+	for _, key := range requestKeys {
+		fmt.Fprintf(w, "compilers_http_requests_total{route=%q,code=%q} %d\n", key[0], key[1], m.requests[key])
+	}
+
+	fmt.Fprintln(w, "# HELP compilers_http_request_bytes_total Bytes read from request bodies.")
+	fmt.Fprintln(w, "# TYPE compilers_http_request_bytes_total counter")
+	fmt.Fprintf(w, "compilers_http_request_bytes_total %d\n", m.bytesIn)
+	fmt.Fprintln(w, "# HELP compilers_http_response_bytes_total Bytes written in response bodies.")
+	fmt.Fprintln(w, "# TYPE compilers_http_response_bytes_total counter")
+	fmt.Fprintf(w, "compilers_http_response_bytes_total %d\n", m.bytesOut)
+
+	fmt.Fprintln(w, "# HELP compilers_compile_duration_seconds Time spent running the compiler.")
+	fmt.Fprintln(w, "# TYPE compilers_compile_duration_seconds histogram")
+	var compileKeys [][2]string
+	for key := range m.compiles {
+		compileKeys = append(compileKeys, key)
+	}
+	sort.Slice(compileKeys, func(i, j int) bool {
+		return compileKeys[i][0]+" "+compileKeys[i][1] < compileKeys[j][0]+" "+compileKeys[j][1]
+	})
+	for _, key := range compileKeys {
+		h := m.compiles[key]
+		labels := fmt.Sprintf("lang=%q,version=%q", key[0], key[1])
+		for i, bound := range compileBuckets {
+			fmt.Fprintf(w, "compilers_compile_duration_seconds_bucket{%s,le=%q} %d\n",
+				labels, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(w, "compilers_compile_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "compilers_compile_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(w, "compilers_compile_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP compilers_compiler_failures_total Compilers which could not be run.")
+	fmt.Fprintln(w, "# TYPE compilers_compiler_failures_total counter")
+	var langs []string
+	for lang := range m.failures {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		fmt.Fprintf(w, "compilers_compiler_failures_total{lang=%q} %d\n", lang, m.failures[lang])
+	}
+
+	hits, misses := atomic.LoadUint64(&m.cacheHits), atomic.LoadUint64(&m.cacheMiss)
+	fmt.Fprintln(w, "# HELP compilers_cache_lookups_total Cache lookups of single includes by result.")
+	fmt.Fprintln(w, "# TYPE compilers_cache_lookups_total counter")
+	fmt.Fprintf(w, "compilers_cache_lookups_total{result=\"hit\"} %d\n", hits)
+	fmt.Fprintf(w, "compilers_cache_lookups_total{result=\"miss\"} %d\n", misses)
+	fmt.Fprintln(w, "# HELP compilers_cache_hit_ratio Fraction of cache lookups which were hits.")
+	fmt.Fprintln(w, "# TYPE compilers_cache_hit_ratio gauge")
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	fmt.Fprintf(w, "compilers_cache_hit_ratio %g\n", ratio)
+
+	fmt.Fprintln(w, "# HELP compilers_queue_depth Compiles waiting for a worker.")
+	fmt.Fprintln(w, "# TYPE compilers_queue_depth gauge")
+	fmt.Fprintf(w, "compilers_queue_depth %d\n", pool.depth())
+
+	led, coalesced := CoalesceStats()
+	fmt.Fprintln(w, "# HELP compilers_compiles_led_total Requests which ran their own compile.")
+	fmt.Fprintln(w, "# TYPE compilers_compiles_led_total counter")
+	fmt.Fprintf(w, "compilers_compiles_led_total %d\n", led)
+	fmt.Fprintln(w, "# HELP compilers_compiles_coalesced_total Requests which shared an identical compile in flight.")
+	fmt.Fprintln(w, "# TYPE compilers_compiles_coalesced_total counter")
+	fmt.Fprintf(w, "compilers_compiles_coalesced_total %d\n", coalesced)
+}
+
+// Serve the server's metrics in the Prometheus text format
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.writeTo(w, s.pool)
+}
+
+// Wrap the routes of mux to count and log requests and the bytes read and
+// written. Requests are labelled with the route pattern they matched so that
+// the number of series stays bounded.
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(rec, r)
+		metrics.request(route, rec.status, body.n, rec.n)
+
+		fields := log.Fields{
+			"route":  route,
+			"status": rec.status,
+			"remote": r.RemoteAddr,
+		}
+		if cert := clientCertificate(r); cert != nil {
+			fields["client"] = cert.Subject.String()
+		}
+		log.WithFields(fields).Info("Served request")
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// Records the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	n      uint64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.n += uint64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the stream endpoint take over the connection
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
@@ -0,0 +1,116 @@
+package perform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/monax/compilers/definitions"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.CompileHandler)
+	mux.HandleFunc("/metrics", server.MetricsHandler)
+	testServer := httptest.NewServer(instrument(mux))
+	defer testServer.Close()
+	// the counters are kept for the whole process, so only what the test
+	// adds to them is checked
+	counts := func() [4]uint64 {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		var compiles uint64
+		for key, h := range metrics.compiles {
+			if key[0] == testLang {
+				compiles += h.count
+			}
+		}
+		return [4]uint64{metrics.requests[[2]string{"/", "200"}], metrics.bytesIn, compiles,
+			atomic.LoadUint64(&metrics.cacheHits) + atomic.LoadUint64(&metrics.cacheMiss)}
+	}
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "A", "contract A\n")
+	reqJ, err := json.Marshal(req)
+	require.NoError(t, err)
+	before := counts()
+	// compile, then hit the cache
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(testServer.URL, "application/json", bytes.NewReader(reqJ))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	after := counts()
+	assert.Equal(t, before[0]+2, after[0])
+	assert.Equal(t, before[1]+2*uint64(len(reqJ)), after[1])
+	assert.Equal(t, before[2]+1, after[2])
+	assert.Equal(t, before[3]+2, after[3])
+
+	resp, err := http.Get(testServer.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	metricsText := string(body)
+
+	assert.Contains(t, metricsText, fmt.Sprintf(`compilers_http_requests_total{route="/",code="200"} %d`, after[0]))
+	assert.Contains(t, metricsText, `compilers_compile_duration_seconds_count{lang="testlang"`)
+	assert.Contains(t, metricsText, `le="+Inf"`)
+	assert.Contains(t, metricsText, "compilers_queue_depth 0")
+	assert.Contains(t, metricsText, fmt.Sprintf("compilers_http_request_bytes_total %d\n", after[1]))
+}
+
+func TestMetricsCountOnce(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.CompileHandler)
+	mux.HandleFunc("/negotiate", server.NegotiateHandler)
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+	counts := func() [3]uint64 {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return [3]uint64{atomic.LoadUint64(&metrics.cacheHits), atomic.LoadUint64(&metrics.cacheMiss),
+			metrics.failures[testLang]}
+	}
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "O", "contract O\n")
+	before := counts()
+	// a negotiated compile misses once, and once cached hits once
+	for i := 0; i < 2; i++ {
+		_, err := negotiateCompile(context.Background(), req, serverAPI{base: testServer.URL}, serverAPI.compile)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, [3]uint64{before[0] + 1, before[1] + 1, before[2]}, counts())
+
+	// errors the compiler reports are not failures to run it
+	addInclude(req, "P", "contract P { boom }\n")
+	before = counts()
+	_, err := compileRequest(context.Background(), nil, req)
+	require.NoError(t, err)
+	assert.Equal(t, before[2], counts()[2])
+}
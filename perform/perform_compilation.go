@@ -2,13 +2,19 @@ package perform
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/monax/compilers/definitions"
 	"github.com/monax/compilers/util"
@@ -22,6 +28,15 @@ type Response struct {
 	Warning string         `json:"warning"`
 	Version string         `json:"version"`
 	Error   string         `json:"error"`
+	Rebuilt []string       `json:"rebuilt,omitempty"` // names of the objects which were compiled
+	Cached  []string       `json:"cached,omitempty"`  // names of the objects served from the cache
+}
+
+// Reply to a NegotiationRequest
+type NegotiationResponse struct {
+	Objects []ResponseItem `json:"objects"` // cached objects of the includes not in Missing
+	Missing []string       `json:"missing"` // includes without cached results
+	Needed  []string       `json:"needed"`  // includes whose scripts must be uploaded
 }
 
 type BinaryResponse struct {
@@ -36,54 +51,74 @@ type ResponseItem struct {
 	ABI        string `json:"abi"` // json encoded
 }
 
-func (resp Response) CacheNewResponse(req definitions.Request) {
+func (resp Response) CacheNewResponse(req definitions.Request) error {
+	return resp.cacheNewResponse(req, resp.Version)
+}
+
+// cache the response, recording the version of the compiler which produced it
+func (resp Response) cacheNewResponse(req definitions.Request, compilerVersion string) error {
 	objects := resp.Objects
 	//log.Debug(objects)
-	cacheLocation := definitions.Languages[req.Language].CacheDir
-	cur, _ := os.Getwd()
-	os.Chdir(cacheLocation)
-	defer func() {
-		os.Chdir(cur)
-	}()
 	for fileDir, metadata := range req.Includes {
-		dir := path.Join(cacheLocation, strings.TrimRight(fileDir, "."+req.Language))
-		os.MkdirAll(dir, 0700)
+		dir := cacheObjectDir(req.Language, fileDir, requestSettings(&req))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		err := writeCacheMeta(dir, &cacheMeta{
+			Language:        req.Language,
+			CompilerVersion: compilerVersion,
+			Optimize:        req.Optimize,
+			Libraries:       req.Libraries,
+			ObjectNames:     metadata.ObjectNames,
+		})
+		if err != nil {
+			return err
+		}
 		objectNames := metadata.ObjectNames
 		for _, name := range objectNames {
 			for _, object := range objects {
 				if object.Objectname == name {
 					//log.WithField("=>", resp.Objects).Debug("Response objects over the loop")
-					CacheResult(object, dir, resp.Warning, resp.Version, resp.Error)
+					if err := CacheResult(object, dir, resp.Warning, resp.Version, resp.Error); err != nil {
+						return err
+					}
 					break
 				}
 			}
 		}
 	}
+	return nil
 }
 
-func linkBinaries(req *definitions.BinaryRequest) *BinaryResponse {
+func linkBinaries(ctx context.Context, req *definitions.BinaryRequest) (*BinaryResponse, error) {
 	// purely for solidity and solidity alone as this is soon to be deprecated.
 	if req.Libraries == "" {
 		return &BinaryResponse{
 			Binary: req.BinaryFile,
 			Error:  "",
-		}
+		}, nil
 	}
 
 	buf := bytes.NewBufferString(req.BinaryFile)
 	var output bytes.Buffer
 	var stderr bytes.Buffer
-	linkCmd := exec.Command("solc", "--link", "--libraries", req.Libraries)
+	linkCmd := exec.CommandContext(ctx, "solc", "--link", "--libraries", req.Libraries)
 	linkCmd.Stdin = buf
 	linkCmd.Stderr = &stderr
 	linkCmd.Stdout = &output
-	linkCmd.Start()
-	linkCmd.Wait()
+	if err := linkCmd.Start(); err != nil {
+		return nil, fmt.Errorf("%w: %s", errCompilerUnavailable, err)
+	}
+	if err := linkCmd.Wait(); ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil && stderr.Len() == 0 {
+		stderr.WriteString(err.Error())
+	}
 
 	return &BinaryResponse{
 		Binary: strings.TrimSpace(output.String()),
 		Error:  stderr.String(),
-	}
+	}, nil
 }
 
 func RequestBinaryLinkage(url string, file string, libraries string) (*BinaryResponse, error) {
@@ -96,19 +131,60 @@ func RequestBinaryLinkage(url string, file string, libraries string) (*BinaryRes
 		BinaryFile: string(code),
 		Libraries:  libraries,
 	}
-	return requestBinaryResponse(request, url)
+	ctx := context.Background()
+	api := discoverAPI(ctx, linkBase(url))
+	if api.version != "" {
+		url = api.route("link")
+	}
+	return requestBinaryResponse(ctx, request, url)
 }
 
-//todo: Might also need to add in a map of library names to addrs
+// todo: Might also need to add in a map of library names to addrs
 func RequestCompile(url string, file string, optimize bool, libraries string) (*Response, error) {
+	return RequestCompileContext(context.Background(), url, file, optimize, libraries)
+}
+
+// Like RequestCompile, giving up on the request or killing the local compiler
+// when ctx is done
+func RequestCompileContext(ctx context.Context, url string, file string, optimize bool, libraries string) (*Response, error) {
+	return requestCompile(ctx, url, file, optimize, libraries, serverAPI.compile)
+}
+
+// Like RequestCompile, but the server compiles the request as a job which is
+// polled until it finishes. Use this for compiles which take longer than the
+// proxies between client and server allow a request to.
+func RequestCompileJob(url string, file string, optimize bool, libraries string) (*Response, error) {
+	return RequestCompileJobContext(context.Background(), url, file, optimize, libraries)
+}
+
+// Like RequestCompileJob, cancelling the job when ctx is done
+func RequestCompileJobContext(ctx context.Context, url string, file string, optimize bool, libraries string) (*Response, error) {
+	return requestCompile(ctx, url, file, optimize, libraries, serverAPI.compileJob)
+}
+
+// compile file locally if url is empty, otherwise on the server at url by
+// way of send
+func requestCompile(ctx context.Context, url string, file string, optimize bool, libraries string,
+	send func(serverAPI, context.Context, *definitions.Request) (*Response, error)) (*Response, error) {
 	config.InitMonaxDir()
 	request, err := CreateRequest(file, libraries, optimize)
 	if err != nil {
 		return nil, err
 	}
+	var resp *Response
+	if url == "" {
+		// compile locally, reusing whatever we have cached
+		resp, err = compileRequest(ctx, nil, request)
+		if err != nil {
+			return nil, err
+		}
+		PrintResponse(*resp, false)
+		return resp, nil
+	}
+
 	//todo: check server for newer version of same files...
 	// go through all includes, check if they have changed
-	cached := CheckCached(request.Includes, request.Language)
+	cached := CheckCached(request)
 
 	log.WithField("cached?", cached).Debug("Cached Item(s)")
 
@@ -119,64 +195,201 @@ func RequestCompile(url string, file string, optimize bool, libraries string) (*
 		}).Debug("check request loop")
 	}*/
 
-	var resp *Response
 	// if everything is cached, no need for request
 	if cached {
 		// TODO: need to return all contracts/libs tied to the original src file
-		resp, err = CachedResponse(request.Includes, request.Language)
-		if err != nil {
+		resp, err = CachedResponse(request)
+		if errors.Is(err, errCorruptCache) {
+			log.Warnf("Ignoring cached result: %s", err)
+			cached = false
+		} else if err != nil {
 			return nil, err
 		}
-	} else {
+	}
+	if !cached {
 		log.Debug("Could not find cached object, compiling...")
-		if url == "" {
-			resp = compile(request)
-		} else {
-			resp, err = requestResponse(request, url)
-			if err != nil {
+		resp, err = negotiateCompile(ctx, request, discoverAPI(ctx, url), send)
+		if err != nil {
+			// a failed compile still carries the compiler's output
+			return resp, err
+		}
+		if err = resp.CacheNewResponse(*request); err != nil {
+			log.Errorln("failed to cache response", err)
+		}
+	}
+
+	PrintResponse(*resp, false)
+
+	return resp, nil
+}
+
+// Serve a request from the cache, compiling only the includes which are not
+// cached along with every include which (transitively) imports one of them.
+// The response lists which objects were rebuilt and which came from the cache.
+// Compiling waits for a worker of pool, if there is one, for as long as ctx
+// allows.
+func compileRequest(ctx context.Context, pool *workerPool, req *definitions.Request) (*Response, error) {
+	cached := make(map[string][]ResponseItem)
+	var stale []string
+	for name, include := range req.Includes {
+		event := CompileEvent{
+			Type:    EventCacheMiss,
+			Include: name,
+			File:    req.FileReplacement[name],
+		}
+		if entryCached(req.Language, name, requestSettings(req), include.ObjectNames) {
+			objects, err := cachedObjects(req.Language, name, requestSettings(req), include.ObjectNames)
+			if err == nil {
+				cached[name] = objects
+				event.Type = EventCacheHit
+				emit(ctx, event)
+				continue
+			} else if !errors.Is(err, errCorruptCache) {
 				return nil, err
 			}
+			log.Warnf("Ignoring cached result: %s", err)
+			event.Message = err.Error()
 		}
-		resp.CacheNewResponse(*request)
+		stale = append(stale, name)
+		emit(ctx, event)
 	}
 
-	PrintResponse(*resp, false)
+	log.WithField("cached?", len(stale) == 0).Debug("Cached Item(s)")
+	metrics.cacheLookups(len(cached), len(stale))
+
+	rebuild := make(map[string]bool)
+	for _, name := range dependents(req, stale) {
+		rebuild[name] = true
+	}
+
+	resp := &Response{
+		Objects: []ResponseItem{},
+		Warning: "",
+		Error:   "",
+	}
+	if len(rebuild) > 0 {
+		var targets []string
+		for name := range rebuild {
+			targets = append(targets, name)
+		}
+		sort.Strings(targets)
+		log.WithField("includes", targets).Debug("Rebuilding")
+
+		var compileErr error
+		err := pool.do(ctx, func() {
+			emit(ctx, CompileEvent{
+				Type:    EventCompileStart,
+				Message: strings.Join(targets, " "),
+			})
+			start := time.Now()
+			resp, compileErr = compile(ctx, req, targets)
+			metrics.compiled(req.Language, compilerVersion(req.Language), time.Since(start))
+		})
+		if err == nil {
+			err = compileErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.Error != "" {
+			return resp, nil
+		}
+		rebuilt := *req
+		rebuilt.Includes = make(map[string]*definitions.IncludedFiles, len(targets))
+		for _, name := range targets {
+			rebuilt.Includes[name] = req.Includes[name]
+		}
+		if err := resp.cacheNewResponse(rebuilt, compilerVersion(req.Language)); err != nil {
+			log.Errorln("failed to cache response", err)
+		}
+	}
+
+	// the compiler also emits the objects of includes imported by the ones we
+	// rebuilt, prefer the cached copies of those
+	fromCache := make(map[string]bool)
+	for name, objects := range cached {
+		if rebuild[name] {
+			continue
+		}
+		for _, object := range objects {
+			fromCache[object.Objectname] = true
+		}
+	}
+	objects := []ResponseItem{}
+	for _, object := range resp.Objects {
+		if !fromCache[object.Objectname] {
+			objects = append(objects, object)
+			resp.Rebuilt = append(resp.Rebuilt, object.Objectname)
+		}
+	}
+	for name, cachedObjects := range cached {
+		if rebuild[name] {
+			continue
+		}
+		for _, object := range cachedObjects {
+			objects = append(objects, object)
+			resp.Cached = append(resp.Cached, object.Objectname)
+		}
+	}
+	resp.Objects = objects
 
 	return resp, nil
 }
 
-// Compile takes a dir and some code, replaces all includes, checks cache, compiles, caches
-func compile(req *definitions.Request) *Response {
+// Compile the target includes of a request in a private workspace holding
+// every include, so that their imports resolve. Diagnostics are sent to the
+// event sink of ctx as the compiler writes them to its standard error. Errors the
+// compiler reports are returned in the Response, errors running it wrap
+// errCompilerUnavailable.
+func compile(ctx context.Context, req *definitions.Request, targets []string) (*Response, error) {
 
 	if _, ok := definitions.Languages[req.Language]; !ok {
-		return compilerResponse("", "", "", "", "", fmt.Errorf("No script provided"))
+		return nil, invalidRequest("unknown language %q", req.Language)
 	}
 
 	lang := definitions.Languages[req.Language]
 
-	includes := []string{}
-	currentDir, _ := os.Getwd()
-	defer os.Chdir(currentDir)
+	if err := os.MkdirAll(lang.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+	workspace, err := ioutil.TempDir(lang.CacheDir, "workspace")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workspace)
 
 	for k, v := range req.Includes {
-		os.Chdir(lang.CacheDir)
-		file, err := util.CreateTemporaryFile(k, v.Script)
+		file, err := util.CreateTemporaryFile(path.Join(workspace, k), v.Script)
 		if err != nil {
-			return compilerResponse("", "", "", "", "", err)
+			return nil, err
 		}
-		defer os.Remove(file.Name())
-		includes = append(includes, file.Name())
 		log.WithField("Filepath of include: ", file.Name()).Debug("To Cache")
 	}
+	includes := targets
 
-	libsFile, err := util.CreateTemporaryFile("monax-libs", []byte(req.Libraries))
+	libsFile, err := util.CreateTemporaryFile(path.Join(workspace, "monax-libs"), []byte(req.Libraries))
 	if err != nil {
-		return compilerResponse("", "", "", "", "", err)
+		return nil, err
 	}
-	defer os.Remove(libsFile.Name())
-	command := lang.Cmd(includes, libsFile.Name(), req.Optimize)
+	command := lang.Cmd(includes, path.Base(libsFile.Name()), req.Optimize)
 	log.WithField("Command: ", command).Debug("Command Input")
-	output, err := runCommand(command...)
+	diagnosticOutput := &diagnosticWriter{
+		fileNames: req.FileReplacement,
+		emit:      func(event CompileEvent) { emit(ctx, event) },
+	}
+	output, cpu, err := runCommandUsage(ctx, workspace, diagnosticOutput, command...)
+	chargeCPU(ctx, cpu)
+	if ctx.Err() != nil {
+		// the compiler was killed, the workspace is removed on return
+		log.WithField("includes", targets).Debug("Compile cancelled")
+		return nil, ctx.Err()
+	}
+	diagnosticOutput.Close()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		metrics.compilerFailed(req.Language)
+		return nil, fmt.Errorf("%w: %s", errCompilerUnavailable, err)
+	}
 
 	var warning string
 	jsonBeginsCertainly := strings.Index(output, `{"contracts":`)
@@ -189,15 +402,13 @@ func compile(req *definitions.Request) *Response {
 	//cleanup
 	log.WithField("=>", output).Debug("Output from command: ")
 	if err != nil {
-		for _, str := range includes {
-			output = strings.Replace(output, str, req.FileReplacement[str], -1)
-		}
+		output = replaceFileNames(output, req.FileReplacement)
 		log.WithFields(log.Fields{
 			"err":      err,
 			"command":  command,
 			"response": output,
 		}).Debug("Could not compile")
-		return compilerResponse("", "", "", "", "", fmt.Errorf("%v", output))
+		return compilerResponse("", "", "", "", "", fmt.Errorf("%v", output)), nil
 	}
 
 	solcResp := definitions.BlankSolcResponse()
@@ -207,7 +418,7 @@ func compile(req *definitions.Request) *Response {
 	err = json.Unmarshal([]byte(output), solcResp)
 	if err != nil {
 		log.Debug("Could not unmarshal json")
-		return compilerResponse("", "", "", "", "", err)
+		return nil, fmt.Errorf("Could not read compiler output: %s", err)
 	}
 	respItemArray := make([]ResponseItem, 0)
 
@@ -232,16 +443,70 @@ func compile(req *definitions.Request) *Response {
 		Objects: respItemArray,
 		Warning: warning,
 		Error:   "",
+	}, nil
+}
+
+// version reported by a language's compiler, or "" if it cannot be run
+func compilerVersion(lang string) string {
+	version, err := probeCompiler(context.Background(), lang)
+	if err != nil {
+		log.WithField("lang", lang).Debugf("Could not get compiler version: %s", err)
+		return ""
 	}
+	return version
 }
 
-func runCommand(tokens ...string) (string, error) {
+// How long to wait for the output of a killed command, which processes it
+// started may hold open
+const commandWaitDelay = time.Second
+
+// run a command in dir, or the current directory if dir is empty. The command
+// is killed should ctx be done before it exits.
+func runCommand(ctx context.Context, dir string, tokens ...string) (string, error) {
+	output, _, err := runCommandUsage(ctx, dir, nil, tokens...)
+	return output, err
+}
+
+// run a command like runCommand, also returning the CPU time it used. What the
+// command writes to its standard error is also written to stderr, if not nil,
+// as it is written.
+func runCommandUsage(ctx context.Context, dir string, stderr io.Writer, tokens ...string) (string, time.Duration, error) {
 	cmd := tokens[0]
 	args := tokens[1:]
-	shellCmd := exec.Command(cmd, args...)
-	output, err := shellCmd.CombinedOutput()
-	s := strings.TrimSpace(string(output))
-	return s, err
+	shellCmd := exec.CommandContext(ctx, cmd, args...)
+	shellCmd.Dir = dir
+	shellCmd.WaitDelay = commandWaitDelay
+	output := new(syncBuffer)
+	shellCmd.Stdout = output
+	shellCmd.Stderr = output
+	if stderr != nil {
+		shellCmd.Stderr = io.MultiWriter(output, stderr)
+	}
+	err := shellCmd.Run()
+	s := strings.TrimSpace(output.String())
+	var cpu time.Duration
+	if shellCmd.ProcessState != nil {
+		cpu = shellCmd.ProcessState.UserTime() + shellCmd.ProcessState.SystemTime()
+	}
+	return s, cpu, err
+}
+
+// output of a command, written to by its standard output and error at once
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
 }
 
 func CreateRequest(file string, libraries string, optimize bool) (*definitions.Request, error) {
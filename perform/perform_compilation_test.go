@@ -0,0 +1,144 @@
+package perform
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Install a stand in compiler for the test language which emits an object for
+// each "contract X" line of the files it is given, reports an error for each
+// file mentioning "boom" and logs its arguments. The prelude, if any, is shell
+// run before compiling, though not when asked for the version, to slow the
+// compiler down or take its place.
+func withFakeCompiler(t *testing.T, prelude ...string) (string, func()) {
+	dir, cleanup := withTestCache(t)
+	compiler := path.Join(dir, "compiler.sh")
+	invocations := path.Join(dir, "invocations")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %s
+case "$1" in
+--version) ;;
+*)
+%s
+;;
+esac
+failed=""
+for f in "$@"; do
+  case "$f" in *.%s)
+    if grep -q boom "$f"; then
+      echo "$f:1:1: Error: boom"
+      failed=1
+    fi;;
+  esac
+done
+[ -z "$failed" ] || exit 1
+printf '{"contracts":{'
+sep=""
+for f in "$@"; do
+  case "$f" in *.%s)
+    for name in $(sed -n 's/^contract \([A-Za-z]*\).*/\1/p' "$f"); do
+      printf '%%s"%%s":{"bin":"%%s","abi":"[]"}' "$sep" "$name" "$name"
+      sep=","
+    done;;
+  esac
+done
+printf '}}'
+`, invocations, strings.Join(prelude, "\n"), testLang, testLang)
+	require.NoError(t, ioutil.WriteFile(compiler, []byte(script), 0755))
+	definitions.Languages[testLang] = definitions.LangConfig{
+		CacheDir:   dir,
+		CompileCmd: []string{compiler, "_"},
+	}
+	return invocations, cleanup
+}
+
+func addInclude(req *definitions.Request, object, script string) string {
+	sum := sha256.Sum256([]byte(script))
+	name := hex.EncodeToString(sum[:]) + "." + testLang
+	req.Includes[name] = &definitions.IncludedFiles{
+		ObjectNames: []string{object},
+		Script:      []byte(script),
+	}
+	return name
+}
+
+func TestIncrementalRecompilation(t *testing.T) {
+	invocations, cleanup := withFakeCompiler(t)
+	defer cleanup()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	b := addInclude(req, "B", "contract B\n")
+	a := addInclude(req, "A", "import \""+b+"\"\ncontract A\n")
+	c := addInclude(req, "C", "contract C\n")
+
+	resp, err := compileRequest(context.Background(), nil, req)
+	require.NoError(t, err)
+	require.Empty(t, resp.Error)
+	sort.Strings(resp.Rebuilt)
+	assert.Equal(t, []string{"A", "B", "C"}, resp.Rebuilt)
+	assert.Empty(t, resp.Cached)
+
+	// everything is cached now
+	resp, err = compileRequest(context.Background(), nil, req)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Rebuilt)
+	assert.Len(t, resp.Cached, 3)
+
+	// losing B means rebuilding B and A, which imports it, but not C
+	require.NoError(t, os.RemoveAll(cacheEntryDir(testLang, b)))
+	require.NoError(t, os.Remove(invocations))
+	resp, err = compileRequest(context.Background(), nil, req)
+	require.NoError(t, err)
+	sort.Strings(resp.Rebuilt)
+	assert.Equal(t, []string{"A", "B"}, resp.Rebuilt)
+	assert.Equal(t, []string{"C"}, resp.Cached)
+	assert.Len(t, resp.Objects, 3)
+
+	logged, err := ioutil.ReadFile(invocations)
+	require.NoError(t, err)
+	assert.Contains(t, string(logged), a)
+	assert.Contains(t, string(logged), b)
+	assert.NotContains(t, string(logged), c)
+	assert.Equal(t, 1, strings.Count(strings.TrimSpace(string(logged)), "\n")+1)
+}
+
+func TestCompileCancelled(t *testing.T) {
+	// a compiler which outlives its shell, holding its output open
+	invocations, cleanup := withFakeCompiler(t, "sleep 10")
+	defer cleanup()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "A", "contract A\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := compileRequest(ctx, nil, req)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "compiler was not killed")
+
+	// the workspace is removed
+	entries, err := ioutil.ReadDir(path.Dir(invocations))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), "workspace"), "%s left behind", entry.Name())
+	}
+}
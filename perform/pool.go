@@ -0,0 +1,107 @@
+package perform
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned when a compile cannot be scheduled
+var (
+	errQueueFull    = errors.New("compile queue is full")
+	errQueueTimeout = errors.New("timed out waiting in the compile queue")
+)
+
+// Bounds the number of compiler processes run at once. Compiles beyond the
+// number of workers wait in a bounded queue for up to a timeout.
+type workerPool struct {
+	admit   chan struct{} // one token per running or queued compile
+	slots   chan struct{} // one token per running compile
+	timeout time.Duration
+	waiting int64
+}
+
+// New pool of workers compilers with room for queueSize more to wait, each for
+// at most timeout. Workers defaults to the number of CPUs, a timeout of zero
+// waits until the caller gives up.
+func newWorkerPool(workers, queueSize int, timeout time.Duration) *workerPool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &workerPool{
+		admit:   make(chan struct{}, workers+queueSize),
+		slots:   make(chan struct{}, workers),
+		timeout: timeout,
+	}
+}
+
+// Run fn on a worker once one is free. Fails with errQueueFull if there is no
+// room to wait, errQueueTimeout if no worker comes free in time or with the
+// error of ctx if it is done first.
+func (p *workerPool) do(ctx context.Context, fn func()) error {
+	if p == nil {
+		fn()
+		return nil
+	}
+	select {
+	case p.admit <- struct{}{}:
+	default:
+		return errQueueFull
+	}
+	defer func() { <-p.admit }()
+
+	var timeout <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	atomic.AddInt64(&p.waiting, 1)
+	select {
+	case p.slots <- struct{}{}:
+		atomic.AddInt64(&p.waiting, -1)
+	case <-timeout:
+		atomic.AddInt64(&p.waiting, -1)
+		return errQueueTimeout
+	case <-ctx.Done():
+		atomic.AddInt64(&p.waiting, -1)
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	fn()
+	return nil
+}
+
+// Whether a compile would be turned away for want of room in the queue
+func (p *workerPool) full() bool {
+	return p != nil && len(p.admit) >= cap(p.admit)
+}
+
+// Number of compiles run or queued at once, zero if there is no limit
+func (p *workerPool) capacity() int {
+	if p == nil {
+		return 0
+	}
+	return cap(p.admit)
+}
+
+// Number of compiles waiting for a worker
+func (p *workerPool) depth() int64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.waiting)
+}
+
+// How long a client turned away should wait before retrying, in seconds
+func (p *workerPool) retryAfter() int {
+	if p == nil || p.timeout < time.Second {
+		return 1
+	}
+	return int(p.timeout / time.Second)
+}
@@ -0,0 +1,58 @@
+package perform
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolQueueFull(t *testing.T) {
+	pool := newWorkerPool(1, 1, 0)
+	release := make(chan struct{})
+	running := make(chan struct{})
+	go pool.do(context.Background(), func() {
+		close(running)
+		<-release
+	})
+	<-running
+	queued := make(chan error)
+	go func() {
+		queued <- pool.do(context.Background(), func() {})
+	}()
+	for pool.depth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// one running and one queued leaves no room
+	assert.Equal(t, errQueueFull, pool.do(context.Background(), func() {}))
+	close(release)
+	assert.NoError(t, <-queued)
+	assert.Equal(t, int64(0), pool.depth())
+}
+
+func TestWorkerPoolQueueTimeout(t *testing.T) {
+	pool := newWorkerPool(1, 1, 50*time.Millisecond)
+	release := make(chan struct{})
+	running := make(chan struct{})
+	go pool.do(context.Background(), func() {
+		close(running)
+		<-release
+	})
+	<-running
+	defer close(release)
+
+	assert.Equal(t, errQueueTimeout, pool.do(context.Background(), func() {}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, pool.do(ctx, func() {}))
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 3*time.Second, retryAfter("3"))
+	assert.Equal(t, time.Second, retryAfter(""))
+	assert.Equal(t, time.Duration(0), retryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+}
@@ -0,0 +1,259 @@
+package perform
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/monax/cli/config"
+	"github.com/monax/cli/log"
+)
+
+// Where SelfSigned keeps the certificates it generates
+var SelfSignedPath = filepath.Join(config.MonaxRoot, "tls")
+
+const (
+	selfSignedCAValidity   = 10 * 365 * 24 * time.Hour
+	selfSignedCertValidity = 365 * 24 * time.Hour
+	// certificates closer than this to expiring are generated again
+	selfSignedRenewBefore = 24 * time.Hour
+)
+
+// Prefix of the CA fingerprints clients pin, as in ClientConfig.CAFingerprint
+const FingerprintPrefix = "sha256:"
+
+// Certificate of a development server signed by a local CA
+type SelfSignedFiles struct {
+	CAFile   string
+	CertFile string // the server certificate followed by the CA's
+	KeyFile  string
+	// of the CA certificate, for clients to pin
+	Fingerprint string
+}
+
+// Generate a local CA and a server certificate it signs for hosts, names or
+// IP addresses, in dir. The CA is kept between runs so that clients need only
+// pin it once, the server certificate is generated again when hosts change or
+// it is about to expire.
+func SelfSigned(dir string, hosts []string) (*SelfSignedFiles, error) {
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hostnames to certify")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files := &SelfSignedFiles{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+	}
+	caKeyFile := filepath.Join(dir, "ca.key")
+
+	ca, caKey, err := loadKeyPair(files.CAFile, caKeyFile)
+	if err != nil || time.Now().Add(selfSignedRenewBefore).After(ca.NotAfter) {
+		log.WithField("dir", dir).Warn("Generating a development CA")
+		ca, caKey, err = createCertificate(files.CAFile, caKeyFile, nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	files.Fingerprint = Fingerprint(ca)
+
+	cert, _, err := loadKeyPair(files.CertFile, files.KeyFile)
+	if err != nil || !certifies(cert, ca, hosts) {
+		log.WithField("hosts", strings.Join(hosts, ",")).Warn("Generating a development server certificate")
+		if _, _, err = createCertificate(files.CertFile, files.KeyFile, hosts, ca, caKey); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// whether cert is signed by ca, names every host and is not about to expire
+func certifies(cert, ca *x509.Certificate, hosts []string) bool {
+	if cert.CheckSignatureFrom(ca) != nil || time.Now().Add(selfSignedRenewBefore).After(cert.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// read the first certificate of certFile and its key
+func loadKeyPair(certFile, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not an ECDSA key", keyFile)
+	}
+	return cert, key, nil
+}
+
+// Write a new key and a certificate for it to certFile and keyFile. The
+// certificate is for hosts signed by ca, or a CA itself if ca is nil.
+func createCertificate(certFile, keyFile string, hosts []string,
+	ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-time.Hour),
+	}
+	if ca == nil {
+		host, _ := os.Hostname()
+		template.Subject = pkix.Name{CommonName: "monax-compilers development CA " + host}
+		template.NotAfter = now.Add(selfSignedCAValidity)
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		ca, caKey = template, key
+	} else {
+		template.Subject = pkix.Name{CommonName: hosts[0]}
+		template.NotAfter = now.Add(selfSignedCertValidity)
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// send the CA along with the server certificate so clients which pin it
+	// find it in the chain
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if template != ca {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// sha256 fingerprint of a certificate, e.g. sha256:AB:CD:...
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	pairs := make([]string, 0, len(sum))
+	for i := 0; i < len(hexSum); i += 2 {
+		pairs = append(pairs, hexSum[i:i+2])
+	}
+	return FingerprintPrefix + strings.Join(pairs, ":")
+}
+
+// the digest of a fingerprint as printed by Fingerprint, colons and case
+// being optional
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	hexSum := strings.Replace(strings.TrimPrefix(fingerprint, FingerprintPrefix), ":", "", -1)
+	sum, err := hex.DecodeString(hexSum)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint %q, expected %s followed by 32 hex bytes", fingerprint, FingerprintPrefix)
+	}
+	return sum, nil
+}
+
+// Verify the server dialled as host, a name or IP address, presented a
+// certificate for host signed by the CA whose sha256 digest is pin, and which
+// it sends in its chain
+func verifyPinned(pin []byte, host string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+	for _, cert := range cs.PeerCertificates {
+		if sum := sha256.Sum256(cert.Raw); !bytes.Equal(sum[:], pin) {
+			continue
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		intermediates := x509.NewCertPool()
+		for _, intermediate := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(intermediate)
+		}
+		// checks the IP addresses of the certificate when host is one
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+	return fmt.Errorf("server certificate is not signed by the pinned CA %s%X", FingerprintPrefix, pin)
+}
+
+// Complete a TLS handshake over conn with the server at addr, host:port,
+// trusting it only if verifyPinned does for the server name of config or
+// else the host of addr. As tls cannot verify the chain without the pinned
+// CA, the handshake itself skips verification.
+func pinnedClient(ctx context.Context, conn net.Conn, config *tls.Config, addr string, pin []byte) (net.Conn, error) {
+	host := config.ServerName
+	if host == "" {
+		var err error
+		if host, _, err = net.SplitHostPort(addr); err != nil {
+			host = addr
+		}
+	}
+	config = config.Clone()
+	config.ServerName = host
+	config.InsecureSkipVerify = true
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := verifyPinned(pin, host, tlsConn.ConnectionState()); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,106 @@
+package perform
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files, err := SelfSigned(dir, []string{"localhost", "127.0.0.1"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(files.Fingerprint, FingerprintPrefix))
+	cert, err := ioutil.ReadFile(files.CertFile)
+	require.NoError(t, err)
+
+	// the certificates are kept between runs
+	again, err := SelfSigned(dir, []string{"localhost", "127.0.0.1"})
+	require.NoError(t, err)
+	assert.Equal(t, files.Fingerprint, again.Fingerprint)
+	certAgain, err := ioutil.ReadFile(files.CertFile)
+	require.NoError(t, err)
+	assert.Equal(t, cert, certAgain)
+
+	// and the server certificate made again for other hosts, by the same CA
+	again, err = SelfSigned(dir, []string{"localhost", "dev.local"})
+	require.NoError(t, err)
+	assert.Equal(t, files.Fingerprint, again.Fingerprint)
+	certAgain, err = ioutil.ReadFile(files.CertFile)
+	require.NoError(t, err)
+	assert.NotEqual(t, cert, certAgain)
+}
+
+func TestPinnedCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files, err := SelfSigned(dir, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	defer func() { Client = ClientConfig{} }()
+
+	srv, err := StartServer(context.Background(), ServerConfig{
+		AddrSecure: "127.0.0.1:9098",
+		AddrGRPC:   "127.0.0.1:9097",
+		CertFile:   files.CertFile,
+		KeyFile:    files.KeyFile,
+	})
+	require.NoError(t, err)
+	listCompilers := func(addr string) error {
+		client, err := DialGRPC(addr, true)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		_, err = client.ListCompilers(context.Background())
+		return err
+	}
+
+	Client = ClientConfig{CAFingerprint: strings.ToLower(files.Fingerprint)}
+	assert.NoError(t, doJSON(context.Background(), "GET", "https://127.0.0.1:9098/version", nil, new(VersionResponse)))
+	assert.NoError(t, listCompilers("127.0.0.1:9097"))
+
+	// the name of the server must still match
+	assert.Error(t, doJSON(context.Background(), "GET", "https://localhost:9098/version", nil, new(VersionResponse)))
+	assert.Error(t, listCompilers("localhost:9097"))
+
+	// and its certificate be signed by the pinned CA, over http and gRPC
+	Client = ClientConfig{CAFingerprint: FingerprintPrefix + strings.Repeat("00", 32)}
+	err = doJSON(context.Background(), "GET", "https://127.0.0.1:9098/version", nil, new(VersionResponse))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pinned CA")
+	err = listCompilers("127.0.0.1:9097")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pinned CA")
+
+	// servers reached by IP address must have it in their certificate
+	pemCerts, err := ioutil.ReadFile(files.CertFile)
+	require.NoError(t, err)
+	var chain tls.ConnectionState
+	for block, rest := pem.Decode(pemCerts); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		chain.PeerCertificates = append(chain.PeerCertificates, cert)
+	}
+	pin, err := parseFingerprint(files.Fingerprint)
+	require.NoError(t, err)
+	assert.NoError(t, verifyPinned(pin, "127.0.0.1", chain))
+	assert.Error(t, verifyPinned(pin, "127.0.0.2", chain))
+
+	Client = ClientConfig{CAFingerprint: "sha256:nope"}
+	assert.Error(t, doJSON(context.Background(), "GET", "https://127.0.0.1:9098/version", nil, new(VersionResponse)))
+
+	require.NoError(t, srv.Close())
+	assertShutdown(t, srv)
+}
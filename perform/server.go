@@ -1,153 +1,591 @@
 package perform
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"net/http"
-	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/definitions/v1"
 
 	"path/filepath"
 
 	"crypto/tls"
 	"io"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/monax/cli/config"
 	"github.com/monax/cli/log"
+	"google.golang.org/grpc"
 )
 
 var BinariesPath = filepath.Join(config.MonaxRoot, "binaries")
 
-// Start the compile server. Takes either or both of addrInsecure or addrSecure
-// to run on HTTP or HTTPS respectively. If addrSecure is passed a certFile and
-// keyFile path must be passed for TLS support.
+// Compile server settings
+type ServerConfig struct {
+	AddrInsecure string // address to serve HTTP on, empty to disable
+	AddrSecure   string // address to serve HTTPS on, empty to disable
+	// address to serve the gRPC API on, empty to disable. Served over TLS
+	// with the HTTPS settings when AddrSecure is set.
+	AddrGRPC string
+	// further addresses to serve HTTP on, each a Unix domain socket as
+	// "unix:<path>" or "systemd" for the sockets passed by systemd socket
+	// activation
+	Listen []string
+	// permissions of the Unix domain sockets, defaults to DefaultSocketMode
+	SocketMode os.FileMode
+	// TLS certificate and key, required with AddrSecure. Re-read when they
+	// change or on SIGHUP.
+	CertFile string
+	KeyFile  string
+	// CA certificates to verify client certificates against. When set,
+	// clients must present a certificate signed by one of them, so the server
+	// refuses to start with AddrInsecure or Listen, which serve plain HTTP.
+	ClientCAFile string
+	// How long to wait for in-flight requests to finish when shutting down
+	// before dropping them
+	GracePeriod time.Duration
+	// Number of compilers to run at once, defaults to the number of CPUs
+	Workers int
+	// Number of compiles which may wait for a worker, beyond which requests
+	// are turned away with 429 Too Many Requests
+	QueueSize int
+	// How long a compile may wait for a worker, zero to wait for as long as
+	// the client does
+	QueueTimeout time.Duration
+	// How long finished jobs are kept, defaults to an hour
+	JobRetention time.Duration
+	// File of API tokens requests must carry one of, empty to accept
+	// requests from anyone. Re-read on SIGHUP.
+	TokenFile string
+	// Rates and daily quotas per client, zero for none
+	Limits LimitConfig
+	// Largest request body read, defaults to DefaultMaxRequestBytes
+	MaxRequestBytes int64
+	// Cross-origin requests to accept, none by default
+	CORS CORSConfig
+}
+
+// A running compile server
+type Server struct {
+	srv       *http.Server
+	listeners netListeners
+	grpc      *grpc.Server  // nil unless serving gRPC
+	certs     *certReloader // nil unless serving TLS
+	// number of listeners being served
+	serving     int
+	gracePeriod time.Duration
+	errs        chan error
+	stopped     chan struct{}
+	// closed once Close has drained the server
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	// API tokens requests must carry one of, nil to accept requests from
+	// anyone
+	tokens *tokenStore
+	// cross-origin requests to accept, nil for none
+	cors *CORSConfig
+	// rates and quotas per client, nil for none
+	limits *rateLimiter
+	// bounds the compilers run at once, nil runs them without limit
+	pool *workerPool
+	// compile jobs submitted to the server
+	jobs *jobStore
+	// largest request body read
+	maxRequestBytes int64
+}
+
+// Start the compile server. Takes either or both of AddrInsecure or AddrSecure
+// to run on HTTP or HTTPS respectively. If AddrSecure is passed a CertFile and
+// KeyFile path must be passed for TLS support.
 //
-// Returns an io.Closer that can be used to close the underlying http(s)
-// listeners and a shutdown channel over which a value is sent if the server is
-// shutdown. That value will be
-func StartServer(addrInsecure, addrSecure, certFile, keyFile string) (io.Closer,
-	chan error) {
+// The server shuts down gracefully when ctx is done or Close is called, use
+// Wait to block until it has.
+func StartServer(ctx context.Context, conf ServerConfig) (*Server, error) {
 	log.Warn("Hello I'm the marmots' compilers server")
 	err := config.InitMonaxDir()
 	if err != nil {
-		log.Errorf("Error making Monax CLI directories: %s", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error making Monax CLI directories: %s", err)
 	}
 	err = config.InitDataDir(BinariesPath)
 	if err != nil {
-		log.Errorf("Error making Monax Keys directories: %s", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error making Monax Keys directories: %s", err)
+	}
+
+	s := &Server{
+		gracePeriod:     conf.GracePeriod,
+		stopped:         make(chan struct{}),
+		closed:          make(chan struct{}),
+		pool:            newWorkerPool(conf.Workers, conf.QueueSize, conf.QueueTimeout),
+		jobs:            newJobStore(defaultJobRetention),
+		maxRequestBytes: DefaultMaxRequestBytes,
+	}
+	if conf.TokenFile != "" {
+		s.tokens, err = loadTokens(conf.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.ClientCAFile != "" {
+		switch {
+		case conf.AddrSecure == "":
+			return nil, fmt.Errorf("Client certificates are only verified over HTTPS, which is not enabled")
+		case conf.AddrInsecure != "" || len(conf.Listen) > 0:
+			return nil, fmt.Errorf("Client certificates are only verified over HTTPS, plain HTTP would let clients without one in")
+		}
+	}
+
+	if conf.MaxRequestBytes > 0 {
+		s.maxRequestBytes = conf.MaxRequestBytes
+	}
+	if len(conf.CORS.AllowedOrigins) > 0 {
+		s.cors = &conf.CORS
+	}
+	if conf.Limits.enabled() {
+		s.limits = newRateLimiter(conf.Limits)
+	}
+	if conf.JobRetention > 0 {
+		s.jobs.retention = conf.JobRetention
 	}
 
-	// Routes on dedicated mux
+	// Routes on dedicated mux. The unversioned routes are the legacy API,
+	// kept for clients which predate /v1.
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", CompileHandler)
-	mux.HandleFunc("/binaries", BinaryHandler)
-	srv := &http.Server{Handler: mux}
+	mux.HandleFunc("/", s.authorize(ScopeCompile, s.limit(s.CompileHandler)))
+	mux.HandleFunc("/binaries", s.authorize(ScopeLink, s.limit(s.BinaryHandler)))
+	mux.HandleFunc("/negotiate", s.authorize(ScopeCompile, s.limitUncounted(s.NegotiateHandler)))
+	mux.HandleFunc("/jobs", s.authorize(ScopeCompile, s.limit(s.JobsHandler)))
+	mux.HandleFunc("/jobs/", s.authorize(ScopeCompile, s.limit(s.JobsHandler)))
+	mux.HandleFunc("/stream", s.authorize(ScopeCompile, s.limit(s.StreamHandler)))
+	mux.HandleFunc("/v1/", unknownRouteHandler)
+	mux.HandleFunc("/v1/compile", s.authorize(ScopeCompile, s.limit(s.CompileV1Handler)))
+	mux.HandleFunc("/v1/link", s.authorize(ScopeLink, s.limit(s.LinkV1Handler)))
+	mux.HandleFunc("/v1/negotiate", s.authorize(ScopeCompile, s.limitUncounted(s.NegotiateHandler)))
+	mux.HandleFunc("/v1/jobs", s.authorize(ScopeCompile, s.limit(s.JobsV1Handler)))
+	mux.HandleFunc("/v1/jobs/", s.authorize(ScopeCompile, s.limit(s.JobsV1Handler)))
+	mux.HandleFunc("/v1/sources", s.authorize(ScopeCompile, s.limit(s.SourcesV1Handler)))
+	mux.HandleFunc("/usage", s.authorize(scopeAny, s.UsageHandler))
+	mux.HandleFunc("/metrics", s.authorize(ScopeAdmin, s.MetricsHandler))
+	mux.HandleFunc("/health", HealthHandler)
+	mux.HandleFunc("/version", VersionHandler)
+	mux.HandleFunc("/compilers", CompilersHandler)
+
+	var handler http.Handler = compress(instrument(mux))
+	if s.cors != nil {
+		handler = withCORS(s.cors, handler)
+	}
 
 	var listeners netListeners
 
 	// Use SSL ?
-	log.Debug(certFile)
+	log.Debug(conf.CertFile)
 
-	// Returns any error from listeners, give it buffer the same size as the
-	// number of listeners to so listener goroutines don't block
-	shutdownChan := make(chan error, 2)
-	if addrSecure != "" {
+	var tlsConfig *tls.Config
+	var certs *certReloader
+	if conf.AddrSecure != "" {
 		log.Debug("Using HTTPS")
-		log.WithField("=>", addrSecure).Debug("Listening on...")
+		log.WithField("=>", conf.AddrSecure).Debug("Listening on...")
 
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		certs, err = loadCertificate(conf.CertFile, conf.KeyFile)
 		if err != nil {
-			log.Errorf("Could not load TLS certificate: %s", err)
-			os.Exit(1)
+			return nil, err
 		}
-		httpsListener, err := tls.Listen("tcp", addrSecure,
-			&tls.Config{Certificates: []tls.Certificate{cert}})
+		tlsConfig = &tls.Config{GetCertificate: certs.getCertificate}
+		if conf.ClientCAFile != "" {
+			clientCAs, err := loadCertPool(conf.ClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("Could not load client CA: %s", err)
+			}
+			tlsConfig.ClientCAs = clientCAs
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		// offer HTTP/2, which gRPC negotiates for itself
+		httpsConfig := tlsConfig.Clone()
+		httpsConfig.NextProtos = []string{"h2", "http/1.1"}
+		httpsListener, err := tls.Listen("tcp", conf.AddrSecure, httpsConfig)
 		if err != nil {
-			log.Errorf("Could not create HTTPS listener: %s", err)
-			os.Exit(1)
+			return nil, fmt.Errorf("Could not create HTTPS listener: %s", err)
 		}
 		listeners = append(listeners, httpsListener)
-		go func() {
-			shutdownChan <- srv.Serve(httpsListener)
-		}()
 	}
-	if addrInsecure != "" {
+	if conf.AddrInsecure != "" {
 		log.Debug("Using HTTP")
-		log.WithField("=>", addrInsecure).Debug("Listening on...")
-		httpListener, err := net.Listen("tcp", addrInsecure)
+		log.WithField("=>", conf.AddrInsecure).Debug("Listening on...")
+		httpListener, err := net.Listen("tcp", conf.AddrInsecure)
 		if err != nil {
-			log.Errorf("Could not create HTTP listener: %s", err)
-			os.Exit(1)
+			listeners.Close()
+			return nil, fmt.Errorf("Could not create HTTP listener: %s", err)
 		}
 		listeners = append(listeners, httpListener)
+	}
+	socketMode := DefaultSocketMode
+	if conf.SocketMode != 0 {
+		socketMode = conf.SocketMode
+	}
+	for _, addr := range conf.Listen {
+		log.WithField("=>", addr).Debug("Listening on...")
+		extra, err := listen(addr, socketMode)
+		if err != nil {
+			listeners.Close()
+			return nil, fmt.Errorf("Could not create listener on %s: %s", addr, err)
+		}
+		listeners = append(listeners, extra...)
+	}
+	var grpcListener net.Listener
+	if conf.AddrGRPC != "" {
+		log.WithField("=>", conf.AddrGRPC).Debug("Serving gRPC on...")
+		grpcListener, err = net.Listen("tcp", conf.AddrGRPC)
+		if err != nil {
+			listeners.Close()
+			return nil, fmt.Errorf("Could not create gRPC listener: %s", err)
+		}
+	}
+
+	s.srv = &http.Server{Handler: handler}
+	s.listeners = listeners
+	s.certs = certs
+	s.serving = len(listeners)
+	// Returns any error from listeners, give it buffer the same size as the
+	// number of listeners to so listener goroutines don't block
+	s.errs = make(chan error, len(listeners)+1)
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			s.errs <- s.srv.Serve(listener)
+		}(listener)
+	}
+	if grpcListener != nil {
+		s.grpc = s.newGRPCServer(tlsConfig)
+		s.serving++
 		go func() {
-			shutdownChan <- srv.Serve(httpListener)
+			err := s.grpc.Serve(grpcListener)
+			select {
+			case <-s.stopped:
+				// grpc reports its listener closing as an error
+				err = http.ErrServerClosed
+			default:
+			}
+			s.errs <- err
 		}()
 	}
-	return listeners, shutdownChan
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Warn("Shutting down compile server")
+			s.Close()
+		case <-s.stopped:
+		}
+	}()
+	if certs != nil {
+		go certs.watch(s.stopped)
+	}
+	if s.tokens != nil || certs != nil {
+		go s.reloadOnHangup()
+	}
+	return s, nil
+}
+
+// Reload the API tokens and TLS certificate of the server whenever it is sent SIGHUP
+func (s *Server) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	for {
+		select {
+		case <-hangups:
+			if err := s.Reload(); err != nil {
+				log.Errorf("Could not reload: %s", err)
+			}
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// Re-read the API tokens and TLS certificate of the server, and probe the
+// compilers afresh. Should either be invalid the server keeps the one it had.
+func (s *Server) Reload() error {
+	forgetCompilerProbes()
+	var err error
+	if s.tokens != nil {
+		err = s.tokens.reload()
+	}
+	if s.certs != nil {
+		if certErr := s.certs.reload(); err == nil {
+			err = certErr
+		}
+	}
+	return err
+}
+
+// Stop accepting connections and wait up to the grace period for in-flight
+// requests to finish before dropping them and closing the listeners
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		defer close(s.closed)
+		close(s.stopped)
+		ctx, cancel := context.WithTimeout(context.Background(), s.gracePeriod)
+		defer cancel()
+		s.closeErr = s.srv.Shutdown(ctx)
+		if s.closeErr == context.DeadlineExceeded {
+			log.Warnf("In-flight requests did not finish within %s, dropping them", s.gracePeriod)
+			s.closeErr = s.srv.Close()
+		}
+		if s.grpc != nil {
+			stopped := make(chan struct{})
+			go func() {
+				s.grpc.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				log.Warnf("In-flight calls did not finish within %s, dropping them", s.gracePeriod)
+				s.grpc.Stop()
+			}
+		}
+		if !s.jobs.drain(ctx) {
+			log.Warnf("Jobs did not finish within %s, cancelling them", s.gracePeriod)
+		}
+	})
+	return s.closeErr
+}
+
+// Block until every listener has stopped and in-flight requests and jobs
+// have been drained. Returns the first error a listener failed with, in which
+// case the rest of the server is shut down too, otherwise any error closing
+// the server.
+func (s *Server) Wait() error {
+	var err error
+	for i := 0; i < s.serving; i++ {
+		if serveErr := <-s.errs; serveErr != http.ErrServerClosed && err == nil {
+			err = serveErr
+			s.Close()
+		}
+	}
+	<-s.closed
+	if err == nil {
+		err = s.closeErr
+	}
+	return err
 }
 
-// Main http request handler
+// Main http request handler, the legacy route of CompileV1Handler
 // Read request, compile, build response object, write
-func CompileHandler(w http.ResponseWriter, r *http.Request) {
-	resp := compileResponse(w, r)
+// A failed compile is answered with 200 OK and the compiler's output in
+// Error, as clients of the legacy routes expect
+func (s *Server) CompileHandler(w http.ResponseWriter, r *http.Request) {
+	resp := s.compileResponse(w, r)
 	if resp == nil {
 		return
 	}
-	respJ, err := json.Marshal(resp)
-	if err != nil {
-		log.Errorln("failed to marshal", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	writeJSON(w, http.StatusOK, resp)
+}
 
-	w.Write(respJ)
+// Link libraries into a binary, the legacy route of LinkV1Handler
+// A failed link is answered with 200 OK and the linker's output in Error
+func (s *Server) BinaryHandler(w http.ResponseWriter, r *http.Request) {
+	resp := s.linkResponse(w, r)
+	if resp == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
-func BinaryHandler(w http.ResponseWriter, r *http.Request) {
+// read a link request from the body and link it. Writes an error and returns
+// nil if the request is unusable or the linker cannot be run.
+func (s *Server) linkResponse(w http.ResponseWriter, r *http.Request) *BinaryResponse {
 	// read the request body
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := readBody(w, r, s.maxRequestBytes)
 	if err != nil {
 		log.Errorln("err on read http request body", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, err)
+		return nil
 	}
 
 	// unmarshall body into req struct
-	req := new(definitions.BinaryRequest)
+	req := new(v1.LinkRequest)
 	err = json.Unmarshal(body, req)
 	if err != nil {
 		log.Errorln("err on json unmarshal of request", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "invalid request: "+err.Error())
+		return nil
+	}
+	resp, err := linkBinaries(r.Context(), linkRequestFromV1(req))
+	if err != nil {
+		writeServerError(w, err)
+		return nil
+	}
+	return resp
+}
+
+// Cache negotiation handler
+// Report cached results and which scripts the client needs to upload
+func (s *Server) NegotiateHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(w, r, s.maxRequestBytes)
+	if err != nil {
+		log.Errorln("err on read http request body", err)
+		writeServerError(w, err)
+		return
 	}
-	resp := linkBinaries(req)
-	respJ, err := json.Marshal(resp)
+
+	reqV1 := new(v1.NegotiationRequest)
+	err = json.Unmarshal(body, reqV1)
 	if err != nil {
-		log.Errorln("failed to marshal", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Errorln("err on json unmarshal of request", err)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	req := negotiationFromV1(reqV1)
+	if err = validateNegotiation(req); err != nil {
+		log.Warnf("Rejecting request: %s", err)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "invalid request: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, negotiationResponseToV1(negotiate(req)))
+}
+
+// work out which includes of a negotiation are cached and which scripts we lack
+func negotiate(req *definitions.NegotiationRequest) *NegotiationResponse {
+	resp := &NegotiationResponse{
+		Objects: []ResponseItem{},
+		Missing: []string{},
+		Needed:  []string{},
+	}
+	settings := compileSettings{Optimize: req.Optimize, Libraries: req.Libraries}
+	for name, objectNames := range req.Includes {
+		var objects []ResponseItem
+		var err error
+		cached := entryCached(req.Language, name, settings, objectNames)
+		if cached {
+			objects, err = cachedObjects(req.Language, name, settings, objectNames)
+			if err != nil {
+				log.Warnf("Ignoring cached result: %s", err)
+				cached = false
+			}
+		}
+		if cached {
+			resp.Objects = append(resp.Objects, objects...)
+		} else {
+			resp.Missing = append(resp.Missing, name)
+		}
+		if !hasScript(req.Language, name) {
+			resp.Needed = append(resp.Needed, name)
+		}
+	}
+	// the includes of a client which goes on to compile are counted then
+	if len(resp.Missing) == 0 {
+		metrics.cacheLookups(len(req.Includes), 0)
+	}
+	log.WithFields(log.Fields{
+		"lang":    req.Language,
+		"missing": resp.Missing,
+		"needed":  resp.Needed,
+	}).Debug("Negotiated cache")
+	return resp
+}
+
+// fill in the scripts a negotiating client left out of its request from the
+// ones we have stored, and store the ones it sent
+func resolveScripts(ctx context.Context, req *definitions.Request) error {
+	source := make(map[string]string, len(req.Includes))
+	for name, include := range req.Includes {
+		if len(include.Script) == 0 {
+			script, ok := loadScript(req.Language, name)
+			if !ok {
+				return fmt.Errorf("no script provided for %s", name)
+			}
+			include.Script = script
+			source[name] = "stored"
+			continue
+		}
+		source[name] = "uploaded"
+		if err := storeScript(req.Language, name, include.Script); err != nil {
+			log.WithField("include", name).Debugf("Not storing script: %s", err)
+		}
 	}
 
-	w.Write(respJ)
+	// imports can only be found once every script is in place
+	graph := importGraph(req)
+	names := make([]string, 0, len(req.Includes))
+	for name := range req.Includes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		emit(ctx, CompileEvent{
+			Type:    EventImport,
+			Include: name,
+			File:    req.FileReplacement[name],
+			Imports: graph[name],
+			Message: source[name],
+		})
+	}
+	return nil
 }
 
 // read in the files from the request, compile them
-func compileResponse(w http.ResponseWriter, r *http.Request) *Response {
+func (s *Server) compileResponse(w http.ResponseWriter, r *http.Request) *Response {
+	req := s.readCompileRequest(w, r)
+	if req == nil {
+		return nil
+	}
+
+	resp, err := serveCompile(r.Context(), s.pool, req)
+	if err == errQueueFull || err == errQueueTimeout {
+		s.turnAway(w, err)
+		return nil
+	} else if err != nil {
+		log.Errorln("err during caching response", err)
+		writeServerError(w, err)
+		return nil
+	}
+
+	return resp
+}
+
+// answer a compile the pool has no room for with when to try again
+func (s *Server) turnAway(w http.ResponseWriter, err error) {
+	log.WithField("queued", s.pool.depth()).Warnf("Turning request away: %s", err)
+	w.Header().Set("Retry-After", strconv.Itoa(s.pool.retryAfter()))
+	writeServerError(w, err)
+}
+
+// read a compile request from the body, filling in the scripts the client
+// left out. Writes an error and returns nil if the request is unusable.
+func (s *Server) readCompileRequest(w http.ResponseWriter, r *http.Request) *definitions.Request {
 	// read the request body
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := readBody(w, r, s.maxRequestBytes)
 	if err != nil {
 		log.Errorln("err on read http request body", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, err)
 		return nil
 	}
 
-	// unmarshall body into req struct
-	req := new(definitions.Request)
-	err = json.Unmarshal(body, req)
+	// unmarshall body into req struct, the legacy routes take the same
+	// request as v1
+	reqV1 := new(v1.CompileRequest)
+	err = json.Unmarshal(body, reqV1)
 	if err != nil {
 		log.Errorln("err on json unmarshal of request", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "invalid request: "+err.Error())
+		return nil
+	}
+	req := requestFromV1(reqV1)
+	if err = validateRequest(req); err != nil {
+		log.Warnf("Rejecting request: %s", err)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "invalid request: "+err.Error())
 		return nil
 	}
 
@@ -158,25 +596,28 @@ func compileResponse(w http.ResponseWriter, r *http.Request) *Response {
 		"incl": req.Includes,
 	}).Debug("New Request")
 
-	cached := CheckCached(req.Includes, req.Language)
-
-	log.WithField("cached?", cached).Debug("Cached Item(s)")
-
-	var resp *Response
-	// if everything is cached, no need for request
-	if cached {
-		resp, err = CachedResponse(req.Includes, req.Language)
-		if err != nil {
-			log.Errorln("err during caching response", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return nil
-		}
-	} else {
-		resp = compile(req)
-		resp.CacheNewResponse(*req)
+	if err = resolveScripts(r.Context(), req); err != nil {
+		log.Errorln("err resolving scripts", err)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return nil
 	}
+	return req
+}
 
-	return resp
+// compile a request on pool, sharing the compile with identical requests in
+// flight
+func serveCompile(ctx context.Context, pool *workerPool, req *definitions.Request) (*Response, error) {
+	resp, err, shared := compileFlights.do(ctx, requestKey(req), func(ctx context.Context) (*Response, error) {
+		return compileRequest(ctx, pool, req)
+	})
+	if shared {
+		led, coalesced := CoalesceStats()
+		log.WithFields(log.Fields{
+			"compiles":  led,
+			"coalesced": coalesced,
+		}).Debug("Coalesced request with one in flight")
+	}
+	return resp, err
 }
 
 type netListeners []net.Listener
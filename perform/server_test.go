@@ -1,27 +1,71 @@
 package perform
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
 	"testing"
 
 	"time"
 
 	"github.com/monax/compilers/definitions"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// A server to call the handlers of directly, which runs compiles without limit
+// and stops the jobs a test left behind on cleanup
+func withTestServer() (*Server, func()) {
+	s := &Server{
+		jobs:            newJobStore(defaultJobRetention),
+		maxRequestBytes: DefaultMaxRequestBytes,
+	}
+	return s, func() {
+		stopped, stop := context.WithCancel(context.Background())
+		stop()
+		s.jobs.drain(stopped)
+	}
+}
+
 func TestStartServer(t *testing.T) {
 	// Check server starting is (probably) idempotent
 	for i := 0; i < 2; i++ {
-		closer, ch := StartServer(":9099", "", "", "")
+		srv, err := StartServer(context.Background(), ServerConfig{AddrInsecure: ":9099"})
+		require.NoError(t, err)
 		// It pains me to do this, but doing it via a ready channel turns out to be
 		// a huge yak shave
 		time.Sleep(time.Second)
-		err := closer.Close()
+		err = srv.Close()
 		assert.NoError(t, err)
-		assertShutdown(t, ch)
+		assertShutdown(t, srv)
 	}
 }
 
+func TestStartServerReturnsErrors(t *testing.T) {
+	_, err := StartServer(context.Background(), ServerConfig{
+		AddrSecure: ":9098",
+		CertFile:   "does-not-exist.pem",
+		KeyFile:    "does-not-exist.key",
+	})
+	assert.Error(t, err)
+}
+
 // This is very crude smoke test but it's better than nothing
 func TestRoutesRunning(t *testing.T) {
 	compiler := definitions.Compiler{
@@ -30,20 +74,269 @@ func TestRoutesRunning(t *testing.T) {
 	}
 
 	// Try compiler root route
-	closer, ch := StartServer(":9099", "", "", "")
-	_, err := requestResponse(compiler.CompilerRequest("", nil, "",
+	srv, err := StartServer(context.Background(), ServerConfig{AddrInsecure: ":9099"})
+	require.NoError(t, err)
+	_, err = requestResponse(context.Background(), compiler.CompilerRequest("", nil, "",
 		true, nil), "http://:9099")
 	assert.NoError(t, err)
 
 	// Try binaries route
-	_, err = requestBinaryResponse(&definitions.BinaryRequest{}, "http://:9099/binaries")
+	_, err = requestBinaryResponse(context.Background(), &definitions.BinaryRequest{}, "http://:9099/binaries")
 	assert.NoError(t, err)
-	err = closer.Close()
+	err = srv.Close()
 	assert.NoError(t, err)
-	assertShutdown(t, ch)
+	assertShutdown(t, srv)
 }
 
-func assertShutdown(t *testing.T, ch chan error) {
-	err := <-ch
-	assert.Contains(t, err.Error(), "use of closed network connection")
+func TestLegacyCompileFailure(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	testServer := httptest.NewServer(http.HandlerFunc(server.CompileHandler))
+	defer testServer.Close()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "A", "contract A { boom }\n")
+
+	// decode the response as clients which predate the error envelope do,
+	// taking any status over 300 for an HTTP error
+	reqJ, err := json.Marshal(req)
+	require.NoError(t, err)
+	httpResp, err := http.Post(testServer.URL, "application/json", bytes.NewBuffer(reqJ))
+	require.NoError(t, err)
+	defer httpResp.Body.Close()
+	require.False(t, httpResp.StatusCode > 300, "HTTP error: %d", httpResp.StatusCode)
+	body, err := ioutil.ReadAll(httpResp.Body)
+	require.NoError(t, err)
+	resp := new(Response)
+	require.NoError(t, json.Unmarshal(body, resp))
+	assert.Contains(t, resp.Error, "Error: boom")
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	// slow the compiler down so the request is in flight when we shut down
+	_, cleanup := withFakeCompiler(t, "sleep 1")
+	defer cleanup()
+	// don't reuse connections to servers from earlier tests
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, err := StartServer(ctx, ServerConfig{AddrInsecure: ":9099", GracePeriod: 10 * time.Second})
+	require.NoError(t, err)
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "D", "contract D\n")
+	done := make(chan *Response)
+	go func() {
+		resp, err := requestResponse(context.Background(), req, "http://:9099")
+		assert.NoError(t, err)
+		done <- resp
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	start := time.Now()
+	// Wait returns once in-flight requests are done, not when shutdown starts
+	assertShutdown(t, srv)
+	assert.True(t, time.Since(start) > 500*time.Millisecond, "Wait returned before the request finished")
+
+	resp := <-done
+	require.NotNil(t, resp)
+	assert.Empty(t, resp.Error)
+	assert.Equal(t, []string{"D"}, resp.Rebuilt)
+}
+
+func TestNegotiation(t *testing.T) {
+	_, cleanup := withTestCache(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	testServer := httptest.NewServer(http.HandlerFunc(server.NegotiateHandler))
+	defer testServer.Close()
+
+	req := testRequest()
+	script := []byte("contract C {}")
+	sum := sha256.Sum256(script)
+	name := hex.EncodeToString(sum[:]) + "." + testLang
+	req.Includes = map[string]*definitions.IncludedFiles{
+		name: {ObjectNames: []string{"C"}, Script: script},
+	}
+	negotiation, err := requestNegotiation(context.Background(), req.Negotiation(), testServer.URL)
+	require.NoError(t, err)
+	assert.Equal(t, []string{name}, negotiation.Missing)
+	assert.Equal(t, []string{name}, negotiation.Needed)
+
+	// once the server holds the script and its results nothing is needed
+	require.NoError(t, resolveScripts(context.Background(), &req))
+	resp := Response{Objects: []ResponseItem{{Objectname: "C", Bytecode: "6060", ABI: "[]"}}}
+	require.NoError(t, resp.CacheNewResponse(req))
+
+	negotiation, err = requestNegotiation(context.Background(), req.Negotiation(), testServer.URL)
+	require.NoError(t, err)
+	assert.Empty(t, negotiation.Missing)
+	assert.Empty(t, negotiation.Needed)
+	assert.Equal(t, resp.Objects, negotiation.Objects)
+
+	// but results compiled with other settings are not served
+	req.Optimize = true
+	negotiation, err = requestNegotiation(context.Background(), req.Negotiation(), testServer.URL)
+	require.NoError(t, err)
+	assert.Equal(t, []string{name}, negotiation.Missing)
+	assert.Empty(t, negotiation.Needed)
+	assert.False(t, CheckCached(&req))
+}
+
+func TestInvalidRequests(t *testing.T) {
+	_, cleanup := withTestCache(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.CompileHandler)
+	mux.HandleFunc("/negotiate", server.NegotiateHandler)
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	script := []byte("contract C {}")
+	sum := sha256.Sum256(script)
+	name := hex.EncodeToString(sum[:]) + "." + testLang
+	for _, invalid := range []definitions.Request{
+		{Language: "cobol"},
+		{Language: testLang, Includes: map[string]*definitions.IncludedFiles{
+			"../../x": {ObjectNames: []string{"C"}, Script: script},
+		}},
+		{Language: testLang, Includes: map[string]*definitions.IncludedFiles{
+			name: {ObjectNames: []string{"../C"}, Script: script},
+		}},
+		{Language: testLang, Includes: map[string]*definitions.IncludedFiles{
+			name: {ObjectNames: []string{"C"}, Script: []byte("contract Poison {}")},
+		}},
+	} {
+		_, err := requestResponse(context.Background(), &invalid, testServer.URL)
+		assert.True(t, errors.Is(err, ErrBadRequest), "%v", err)
+		_, err = requestNegotiation(context.Background(), invalid.Negotiation(), routeURL(testServer.URL, "negotiate"))
+		if invalid.Includes[name] == nil {
+			assert.True(t, errors.Is(err, ErrBadRequest), "%v", err)
+		}
+	}
+	_, err := os.Stat(cacheEntryDir(testLang, name))
+	assert.True(t, os.IsNotExist(err), "rejected requests are not cached")
+
+	resp, err := http.Post(testServer.URL, "application/json", strings.NewReader("{"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	server.maxRequestBytes = 16
+	resp, err = http.Post(testServer.URL, "application/json",
+		strings.NewReader(`{"language":"`+testLang+`","includes":{}}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func assertShutdown(t *testing.T, srv *Server) {
+	assert.NoError(t, srv.Wait())
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca, caKey := writeTestCA(t, path.Join(dir, "ca.pem"))
+	serverCert, serverKey := writeTestCert(t, ca, caKey, "localhost", dir)
+	clientCert, clientKey := writeTestCert(t, ca, caKey, "build server", dir)
+	tokenFile := path.Join(dir, "tokens")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("cn:build server link\n"), 0600))
+	defer func() { Client = ClientConfig{} }()
+
+	// plain http would let clients without a certificate in
+	_, err = StartServer(context.Background(), ServerConfig{
+		AddrInsecure: "localhost:9099",
+		AddrSecure:   "localhost:9098",
+		CertFile:     serverCert,
+		KeyFile:      serverKey,
+		ClientCAFile: path.Join(dir, "ca.pem"),
+	})
+	assert.Error(t, err)
+
+	srv, err := StartServer(context.Background(), ServerConfig{
+		AddrSecure:   "localhost:9098",
+		CertFile:     serverCert,
+		KeyFile:      serverKey,
+		ClientCAFile: path.Join(dir, "ca.pem"),
+		TokenFile:    tokenFile,
+	})
+	require.NoError(t, err)
+
+	// the server is trusted through the private CA but turns away clients
+	// without a certificate
+	Client = ClientConfig{CAFile: path.Join(dir, "ca.pem")}
+	_, err = requestBinaryResponse(context.Background(), &definitions.BinaryRequest{}, "https://localhost:9098/binaries")
+	assert.Error(t, err)
+
+	// the subject of the certificate is granted the link scope only
+	Client = ClientConfig{CertFile: clientCert, KeyFile: clientKey, CAFile: path.Join(dir, "ca.pem")}
+	_, err = requestBinaryResponse(context.Background(), &definitions.BinaryRequest{}, "https://localhost:9098/binaries")
+	assert.NoError(t, err)
+	_, err = requestResponse(context.Background(), &definitions.Request{}, "https://localhost:9098/")
+	assert.True(t, errors.Is(err, ErrForbidden), "%v", err)
+
+	require.NoError(t, srv.Close())
+	assertShutdown(t, srv)
+}
+
+// write a self signed CA certificate to file
+func writeTestCA(t *testing.T, file string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return cert, key
+}
+
+// write a certificate for commonName signed by ca to dir, returning the paths
+// of the certificate and its key
+func writeTestCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey,
+	commonName, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile := path.Join(dir, commonName+".pem")
+	keyFile := path.Join(dir, commonName+".key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
 }
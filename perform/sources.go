@@ -0,0 +1,141 @@
+package perform
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/definitions/v1"
+	"github.com/monax/compilers/util"
+
+	"github.com/monax/cli/log"
+)
+
+// Compile handler for sources sent as they are, for clients such as browsers
+// which cannot hash their includes as CreateRequest does. Diagnostics of a
+// failed compile name the sources by their paths.
+func (s *Server) SourcesV1Handler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(w, r, s.maxRequestBytes)
+	if err != nil {
+		log.Errorln("err on read http request body", err)
+		writeServerError(w, err)
+		return
+	}
+	sources := new(v1.SourcesRequest)
+	if err = json.Unmarshal(body, sources); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	req, err := sourcesToRequest(sources)
+	if err == nil {
+		err = validateRequest(req)
+	}
+	if err != nil {
+		log.Warnf("Rejecting request: %s", err)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if err = resolveScripts(r.Context(), req); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	resp, err := serveCompile(r.Context(), s.pool, req)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if resp.Error != "" {
+		// the response may be shared with other requests
+		failed := *resp
+		failed.Error = replaceFileNames(resp.Error, req.FileReplacement)
+		writeCompileError(w, &failed)
+		return
+	}
+	writeJSON(w, http.StatusOK, responseToV1(resp))
+}
+
+// Build a compile request from sources by path, naming each include after
+// its hash as CreateRequest does for files on disk
+func sourcesToRequest(req *v1.SourcesRequest) (*definitions.Request, error) {
+	if len(req.Sources) == 0 {
+		return nil, invalidRequest("no sources")
+	}
+	sources := make(map[string][]byte, len(req.Sources))
+	for name, content := range req.Sources {
+		sources[path.Clean(name)] = []byte(content)
+	}
+	main := req.Main
+	if len(main) == 0 {
+		for name := range sources {
+			main = append(main, name)
+		}
+		sort.Strings(main)
+	}
+	lang := req.Language
+	if lang == "" {
+		var err error
+		if lang, err = util.LangFromFile(main[0]); err != nil {
+			return nil, invalidRequest("%s", err)
+		}
+	}
+	if err := validateLanguage(lang); err != nil {
+		return nil, err
+	}
+
+	compiler := &definitions.Compiler{
+		Config:  definitions.Languages[lang],
+		Lang:    lang,
+		Sources: sources,
+	}
+	includePattern, err := regexp.Compile(compiler.IncludeRegex())
+	if err != nil {
+		return nil, err
+	}
+	includes := make(map[string]*definitions.IncludedFiles)
+	replacement := make(map[string]string)
+	visiting := make(map[string]bool)
+	for _, name := range main {
+		name = path.Clean(name)
+		code, ok := sources[name]
+		if !ok {
+			return nil, invalidRequest("no source for %s", name)
+		}
+		// includes are replaced recursively, which an import cycle would
+		// never finish
+		if err := checkImportCycle(includePattern, sources, name, visiting); err != nil {
+			return nil, err
+		}
+		if _, err := compiler.ReplaceIncludes(code, path.Dir(name), name, includes, replacement); err != nil {
+			return nil, invalidRequest("%s", err)
+		}
+	}
+	return compiler.CompilerRequest("", includes, req.Libraries, req.Optimize, replacement), nil
+}
+
+// fail if a source imports itself, directly or by way of others. visiting
+// holds the sources being checked, true while their imports are.
+func checkImportCycle(includePattern *regexp.Regexp, sources map[string][]byte,
+	name string, visiting map[string]bool) error {
+	if checking, seen := visiting[name]; seen {
+		if checking {
+			return invalidRequest("%s imports itself", name)
+		}
+		return nil
+	}
+	visiting[name] = true
+	for _, m := range includePattern.FindAllSubmatch(sources[name], -1) {
+		if len(m) < 4 {
+			continue
+		}
+		imported := path.Join(path.Dir(name), string(m[3]))
+		if err := checkImportCycle(includePattern, sources, imported, visiting); err != nil {
+			return err
+		}
+	}
+	visiting[name] = false
+	return nil
+}
@@ -0,0 +1,90 @@
+package perform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/definitions/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourcesHandler(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	langConfig := definitions.Languages[testLang]
+	langConfig.IncludeRegex = definitions.Languages[definitions.SOLIDITY].IncludeRegex
+	definitions.Languages[testLang] = langConfig
+	testServer := httptest.NewServer(http.HandlerFunc(server.SourcesV1Handler))
+	defer testServer.Close()
+
+	sources := &v1.SourcesRequest{
+		Sources: map[string]string{
+			"contracts/A.testlang":     "import \"./lib/B.testlang\";\ncontract A {}\n",
+			"contracts/lib/B.testlang": "contract B {}\n",
+		},
+		Main: []string{"contracts/A.testlang"},
+	}
+	resp := new(v1.CompileResponse)
+	require.NoError(t, doJSON(context.Background(), "POST", testServer.URL, sources, resp))
+	var names []string
+	for _, object := range resp.Objects {
+		names = append(names, object.Objectname)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"A", "B"}, names)
+
+	// diagnostics name the sources by their paths
+	sources.Sources["contracts/lib/B.testlang"] = "contract B { boom }\n"
+	err := doJSON(context.Background(), "POST", testServer.URL, sources, resp)
+	var serverErr *ServerError
+	require.True(t, errors.As(err, &serverErr), "%v", err)
+	assert.Equal(t, CodeCompileFailed, serverErr.Code)
+	assert.Contains(t, serverErr.Message, ".testlang:1:1: Error: boom")
+	assert.NotRegexp(t, "[0-9a-f]{64}", serverErr.Message)
+
+	// imports must be sent and must not go round in circles
+	sources.Sources = map[string]string{"contracts/A.testlang": "import \"./C.testlang\";\ncontract A {}\n"}
+	err = doJSON(context.Background(), "POST", testServer.URL, sources, resp)
+	assert.True(t, errors.Is(err, ErrBadRequest), "%v", err)
+	sources.Sources["contracts/C.testlang"] = "import \"./A.testlang\";\ncontract C {}\n"
+	err = doJSON(context.Background(), "POST", testServer.URL, sources, resp)
+	assert.True(t, errors.Is(err, ErrBadRequest), "%v", err)
+	assert.Contains(t, err.Error(), "imports itself")
+}
+
+func TestSourcesDiamondImports(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	langConfig := definitions.Languages[testLang]
+	langConfig.IncludeRegex = definitions.Languages[definitions.SOLIDITY].IncludeRegex
+	definitions.Languages[testLang] = langConfig
+
+	// each level imports the next along two paths, which replacing every
+	// import afresh would take 2^depth replacements of the last level for
+	const depth = 40
+	sources := &v1.SourcesRequest{Sources: map[string]string{
+		fmt.Sprintf("L%d.testlang", depth): "contract Last {}\n",
+	}}
+	for i := 0; i < depth; i++ {
+		sources.Sources[fmt.Sprintf("L%d.testlang", i)] = fmt.Sprintf(
+			"import \"./X%d.testlang\";\nimport \"./Y%d.testlang\";\ncontract L%d {}\n", i, i, i)
+		for _, side := range []string{"X", "Y"} {
+			sources.Sources[fmt.Sprintf("%s%d.testlang", side, i)] = fmt.Sprintf(
+				"import \"./L%d.testlang\";\ncontract %s%d {}\n", i+1, side, i)
+		}
+	}
+	sources.Main = []string{"L0.testlang"}
+	req, err := sourcesToRequest(sources)
+	require.NoError(t, err)
+	assert.Len(t, req.Includes, len(sources.Sources))
+}
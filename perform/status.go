@@ -0,0 +1,255 @@
+package perform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/version"
+
+	"github.com/monax/cli/log"
+)
+
+// Server health, reported by /health
+type HealthResponse struct {
+	Status    string                    `json:"status"`
+	Compilers map[string]CompilerHealth `json:"compilers"`
+}
+
+// Whether the compiler of a language runs
+type CompilerHealth struct {
+	OK      bool   `json:"ok"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	// every compiler runs
+	HealthOK = "ok"
+	// some compilers do not run
+	HealthDegraded = "degraded"
+	// no compiler runs
+	HealthDown = "down"
+)
+
+// Server version, reported by /version
+type VersionResponse struct {
+	Version string `json:"version"`
+}
+
+// Languages and features a server supports, reported by /compilers
+type CompilersResponse struct {
+	Compilers []CompilerInfo `json:"compilers"`
+	// optional routes the server serves, e.g. "negotiate" or "jobs"
+	Features []string `json:"features"`
+	// versions of the API served under their own route prefix, e.g. "v1".
+	// Servers which leave it out only serve the legacy routes.
+	APIVersions []string `json:"apiVersions"`
+}
+
+// A language the server compiles
+type CompilerInfo struct {
+	Language  string `json:"language"`
+	Installed bool   `json:"installed"`
+	Version   string `json:"version,omitempty"`
+	// request options the compiler honours
+	Options []string `json:"options"`
+}
+
+// Request options honoured by the compiler of each language
+var compilerOptions = map[string][]string{
+	definitions.SOLIDITY: {"optimize", "libraries"},
+	definitions.SERPENT:  {},
+	definitions.LLL:      {},
+}
+
+// Optional routes served by StartServer
+var serverFeatures = []string{"binaries", "jobs", "metrics", "negotiate", "sources", "stream"}
+
+// How long what a compiler reported when probed is reused for, so that status
+// requests do not each run every compiler
+const probeTTL = 30 * time.Second
+
+// a compiler's answer to --version
+type compilerProbe struct {
+	version string
+	err     error
+	at      time.Time
+}
+
+var (
+	compilerProbesLock sync.Mutex
+	// by compiler executable
+	compilerProbes = make(map[string]compilerProbe)
+)
+
+// the version a language's compiler reports, running it at most once every
+// probeTTL. Probes cut short by ctx are not kept.
+func probeCompiler(ctx context.Context, lang string) (string, error) {
+	langConfig, ok := definitions.Languages[lang]
+	if !ok || len(langConfig.CompileCmd) == 0 {
+		return "", fmt.Errorf("no compiler configured for %s", lang)
+	}
+	compiler := langConfig.CompileCmd[0]
+	compilerProbesLock.Lock()
+	defer compilerProbesLock.Unlock()
+	if probe, ok := compilerProbes[compiler]; ok && time.Since(probe.at) < probeTTL {
+		return probe.version, probe.err
+	}
+	version, err := runVersion(ctx, compiler)
+	if ctx.Err() == nil {
+		compilerProbes[compiler] = compilerProbe{version: version, err: err, at: time.Now()}
+	}
+	return version, err
+}
+
+// forget what compilers reported, for when they may have been replaced
+func forgetCompilerProbes() {
+	compilerProbesLock.Lock()
+	defer compilerProbesLock.Unlock()
+	compilerProbes = make(map[string]compilerProbe)
+}
+
+// run a compiler and return the version it reports
+func runVersion(ctx context.Context, compiler string) (string, error) {
+	output, err := runCommand(ctx, "", compiler, "--version")
+	if err != nil {
+		return "", fmt.Errorf("%s --version: %s", compiler, err)
+	}
+	// solc prints a banner followed by "Version: x.y.z+commit..."
+	lines := strings.Split(output, "\n")
+	version := strings.TrimSpace(lines[len(lines)-1])
+	for _, line := range lines {
+		if i := strings.Index(line, "Version:"); i >= 0 {
+			version = strings.TrimSpace(line[i+len("Version:"):])
+		}
+	}
+	return version, nil
+}
+
+func sortedLanguages() []string {
+	var langs []string
+	for lang := range definitions.Languages {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// check that each compiler runs
+func checkHealth(ctx context.Context) *HealthResponse {
+	health := &HealthResponse{
+		Status:    HealthOK,
+		Compilers: make(map[string]CompilerHealth, len(definitions.Languages)),
+	}
+	running := 0
+	for _, lang := range sortedLanguages() {
+		version, err := probeCompiler(ctx, lang)
+		if err != nil {
+			health.Compilers[lang] = CompilerHealth{Error: err.Error()}
+			continue
+		}
+		running++
+		health.Compilers[lang] = CompilerHealth{OK: true, Version: version}
+	}
+	if running == 0 {
+		health.Status = HealthDown
+	} else if running < len(definitions.Languages) {
+		health.Status = HealthDegraded
+	}
+	return health
+}
+
+// list the languages the server compiles and what it supports
+func listCompilers(ctx context.Context) *CompilersResponse {
+	compilers := &CompilersResponse{
+		Compilers:   []CompilerInfo{},
+		Features:    serverFeatures,
+		APIVersions: serverAPIVersions,
+	}
+	for _, lang := range sortedLanguages() {
+		version, err := probeCompiler(ctx, lang)
+		info := CompilerInfo{
+			Language:  lang,
+			Installed: err == nil,
+			Version:   version,
+			Options:   compilerOptions[lang],
+		}
+		if info.Options == nil {
+			info.Options = []string{}
+		}
+		compilers.Compilers = append(compilers.Compilers, info)
+	}
+	return compilers
+}
+
+// Liveness of the server and whether each compiler runs. Answers 503 Service
+// Unavailable only when no compiler runs, as servers commonly lack some.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	health := checkHealth(r.Context())
+	if health.Status == HealthDown {
+		writeJSON(w, http.StatusServiceUnavailable, health)
+		return
+	}
+	writeJSON(w, http.StatusOK, health)
+}
+
+// Version of the server
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &VersionResponse{Version: version.VERSION})
+}
+
+// Languages, compiler versions and options the server supports
+func CompilersHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, listCompilers(r.Context()))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	respJ, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln("failed to marshal", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(respJ)
+}
+
+// Everything a server reports about itself
+type ServerStatus struct {
+	Version   *VersionResponse   `json:"version"`
+	Health    *HealthResponse    `json:"health"`
+	Compilers *CompilersResponse `json:"compilers"`
+}
+
+// Query the status endpoints of the server whose compile route is at url
+func RequestStatus(url string) (*ServerStatus, error) {
+	status := &ServerStatus{
+		Version:   new(VersionResponse),
+		Health:    new(HealthResponse),
+		Compilers: new(CompilersResponse),
+	}
+	if err := doJSON(context.Background(), "GET", routeURL(url, "version"), nil, status.Version); err != nil {
+		return nil, err
+	}
+	if err := doJSON(context.Background(), "GET", routeURL(url, "health"), nil, status.Health); err != nil {
+		// the server is up but none of its compilers run
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusServiceUnavailable {
+			return nil, err
+		}
+		status.Health.Status = HealthDown
+	}
+	if err := doJSON(context.Background(), "GET", routeURL(url, "compilers"), nil, status.Compilers); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,76 @@
+package perform
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/monax/compilers/definitions"
+	"github.com/monax/compilers/version"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestStatus(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	languages := definitions.Languages
+	defer func() { definitions.Languages = languages }()
+	definitions.Languages = map[string]definitions.LangConfig{
+		testLang: languages[testLang],
+		"absent": {CompileCmd: []string{"/nonexistent/compiler", "_"}},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", HealthHandler)
+	mux.HandleFunc("/version", VersionHandler)
+	mux.HandleFunc("/compilers", CompilersHandler)
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	status, err := RequestStatus(testServer.URL + "/")
+	require.NoError(t, err)
+	assert.Equal(t, version.VERSION, status.Version.Version)
+
+	assert.Equal(t, HealthDegraded, status.Health.Status)
+	assert.True(t, status.Health.Compilers[testLang].OK)
+	assert.NotEmpty(t, status.Health.Compilers[testLang].Version)
+	assert.False(t, status.Health.Compilers["absent"].OK)
+	assert.NotEmpty(t, status.Health.Compilers["absent"].Error)
+
+	require.Len(t, status.Compilers.Compilers, 2)
+	assert.Equal(t, "absent", status.Compilers.Compilers[0].Language)
+	assert.False(t, status.Compilers.Compilers[0].Installed)
+	assert.Equal(t, testLang, status.Compilers.Compilers[1].Language)
+	assert.True(t, status.Compilers.Compilers[1].Installed)
+	assert.Contains(t, status.Compilers.Features, "negotiate")
+
+	delete(definitions.Languages, testLang)
+	status, err = RequestStatus(testServer.URL + "/")
+	require.NoError(t, err)
+	assert.Equal(t, HealthDown, status.Health.Status)
+}
+
+func TestCompilerProbesAreReused(t *testing.T) {
+	invocations, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	probes := func() int {
+		calls, _ := ioutil.ReadFile(invocations)
+		return strings.Count(string(calls), "--version")
+	}
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		HealthHandler(w, httptest.NewRequest("GET", "/health", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		CompilersHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/compilers", nil))
+	}
+	assert.Equal(t, 1, probes())
+
+	forgetCompilerProbes()
+	HealthHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, 2, probes())
+}
@@ -0,0 +1,97 @@
+package perform
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"net/http"
+
+	"github.com/monax/compilers/definitions"
+
+	"github.com/gorilla/websocket"
+	"github.com/monax/cli/log"
+)
+
+// how long sending a single event may take
+const streamWriteWait = 10 * time.Second
+
+// WebSocket handler streaming the progress of a compile
+// The client sends a Request as its first message and is then sent
+// CompileEvents until one of type EventResponse or EventError, after which
+// the connection is closed. The compile is cancelled should the client close
+// the connection first.
+func (s *Server) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
+		return checkOrigin(s.cors, r)
+	}}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has replied with an error already
+		log.Errorln("failed to upgrade to websocket", err)
+		return
+	}
+	defer conn.Close()
+
+	var sendLock sync.Mutex
+	send := func(event CompileEvent) {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+		if err := conn.WriteJSON(event); err != nil {
+			log.WithField("type", event.Type).Debugf("Could not send event: %s", err)
+		}
+	}
+	fail := func(err error) {
+		log.Errorln("err streaming compile", err)
+		send(CompileEvent{Type: EventError, Message: err.Error()})
+	}
+
+	conn.SetReadLimit(s.maxRequestBytes)
+	req := new(definitions.Request)
+	if err = conn.ReadJSON(req); err != nil {
+		fail(err)
+		return
+	}
+	if err = validateRequest(req); err != nil {
+		fail(fmt.Errorf("invalid request: %s", err))
+		return
+	}
+	log.WithFields(log.Fields{
+		"lang": req.Language,
+		"libs": req.Libraries,
+	}).Debug("New Streaming Request")
+
+	// the hijacked connection no longer cancels the context of the request,
+	// so it is read until the client closes it or goes away
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				log.Debugf("Stream closed: %s", err)
+				return
+			}
+		}
+	}()
+
+	ctx = withEventSink(ctx, send)
+	if err = resolveScripts(ctx, req); err != nil {
+		fail(err)
+		return
+	}
+	resp, err := serveCompile(ctx, s.pool, req)
+	if err != nil {
+		fail(err)
+		return
+	}
+	send(CompileEvent{Type: EventResponse, Response: resp})
+
+	sendLock.Lock()
+	defer sendLock.Unlock()
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(streamWriteWait))
+}
@@ -0,0 +1,154 @@
+package perform
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/monax/compilers/definitions"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamHandler(t *testing.T) {
+	_, cleanup := withFakeCompiler(t)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	testServer := httptest.NewServer(http.HandlerFunc(server.StreamHandler))
+	defer testServer.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testServer.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	b := addInclude(req, "B", "contract B\n")
+	a := addInclude(req, "A", "import \""+b+"\"\ncontract A\n")
+	require.NoError(t, conn.WriteJSON(req))
+
+	var events []CompileEvent
+	for {
+		event := CompileEvent{}
+		require.NoError(t, conn.ReadJSON(&event))
+		events = append(events, event)
+		if event.Type == EventResponse || event.Type == EventError {
+			break
+		}
+	}
+
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+		if event.Type == EventImport && event.Include == a {
+			assert.Equal(t, []string{b}, event.Imports)
+		}
+	}
+	assert.Equal(t, []string{EventImport, EventImport, EventCacheMiss, EventCacheMiss,
+		EventCompileStart, EventResponse}, types)
+	assert.Len(t, events[len(events)-1].Response.Objects, 2)
+}
+
+func TestStreamClosed(t *testing.T) {
+	// a compiler which notes its pid and runs until it is killed
+	invocations, cleanup := withFakeCompiler(t, `echo $$ > "$(dirname "$0")/pid"; exec sleep 60`)
+	defer cleanup()
+	server, closeServer := withTestServer()
+	defer closeServer()
+	pidFile := path.Join(path.Dir(invocations), "pid")
+	// closing the server does not wait for hijacked connections
+	handled := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handled)
+		server.StreamHandler(w, r)
+	}))
+	defer testServer.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(testServer.URL, "http"), nil)
+	require.NoError(t, err)
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "S", "contract S\n")
+	require.NoError(t, conn.WriteJSON(req))
+	var pid int
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if contents, err := ioutil.ReadFile(pidFile); err == nil && strings.HasSuffix(string(contents), "\n") {
+			pid, err = strconv.Atoi(strings.TrimSpace(string(contents)))
+			require.NoError(t, err)
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "compiler did not start")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the client going away mid-compile kills the compiler
+	require.NoError(t, conn.Close())
+	deadline = time.Now().Add(5 * time.Second)
+	for syscall.Kill(pid, 0) == nil {
+		require.True(t, time.Now().Before(deadline), "compiler %d still running", pid)
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return")
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	output := `abc.sol:3:5: Warning: Unused local variable
+        uint8[5] memory foo3 = [1, 1, 1, 1, 1];
+        ^------------------^
+abc.sol:7:1: Error: Expected token Semicolon
+}
+^`
+	events := diagnostics(output, map[string]string{"abc.sol": "contracts/simple.sol"})
+	require.Len(t, events, 2)
+	assert.Equal(t, "warning", events[0].Severity)
+	assert.Equal(t, "contracts/simple.sol", events[0].File)
+	assert.True(t, strings.HasPrefix(events[0].Message, "contracts/simple.sol:3:5: Warning"))
+	assert.Equal(t, 3, strings.Count(events[0].Message, "\n")+1)
+	assert.Equal(t, "error", events[1].Severity)
+}
+
+func TestDiagnosticsAreLive(t *testing.T) {
+	// a compiler which warns well before it finishes
+	_, cleanup := withFakeCompiler(t, `printf 'a:1:1: Warning: early\n  detail\nb:2:1: Warning: late\n' >&2; sleep 1`)
+	defer cleanup()
+
+	req := &definitions.Request{
+		Language: testLang,
+		Includes: make(map[string]*definitions.IncludedFiles),
+	}
+	addInclude(req, "E", "contract E\n")
+	var diagnostics []CompileEvent
+	var first time.Time
+	ctx := withEventSink(context.Background(), func(event CompileEvent) {
+		if event.Type == EventDiagnostic {
+			if first.IsZero() {
+				first = time.Now()
+			}
+			diagnostics = append(diagnostics, event)
+		}
+	})
+	_, err := compileRequest(ctx, nil, req)
+	require.NoError(t, err)
+	require.Len(t, diagnostics, 2)
+	assert.Equal(t, "a:1:1: Warning: early\n  detail", diagnostics[0].Message)
+	assert.True(t, time.Since(first) > 500*time.Millisecond, "diagnostic sent once the compiler exited")
+}
@@ -0,0 +1,108 @@
+package perform
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/monax/compilers/definitions"
+)
+
+// Largest request body the server reads, by default
+const DefaultMaxRequestBytes = 16 << 20
+
+// Object names become file names in the cache, so they are restricted to
+// identifiers
+var objectNamePattern = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// A request the server refuses, the message explains why
+type invalidRequestError struct {
+	msg string
+}
+
+func (e invalidRequestError) Error() string {
+	return e.msg
+}
+
+func invalidRequest(format string, args ...interface{}) error {
+	return invalidRequestError{fmt.Sprintf(format, args...)}
+}
+
+// A request body larger than the server reads
+type requestTooLargeError struct {
+	limit int64
+}
+
+func (e requestTooLargeError) Error() string {
+	return fmt.Sprintf("request body is larger than %d bytes", e.limit)
+}
+
+// read a request body of at most limit bytes
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, requestTooLargeError{limit}
+	}
+	return body, err
+}
+
+// check the language is one the server compiles
+func validateLanguage(lang string) error {
+	if _, ok := definitions.Languages[lang]; !ok {
+		return invalidRequest("unknown language %q", lang)
+	}
+	return nil
+}
+
+// check an include is named <sha256>.<lang> and its objects are identifiers,
+// so that neither can name a file outside its cache entry
+func validateInclude(lang, name string, objectNames []string) error {
+	hash := strings.TrimSuffix(name, "."+lang)
+	if hash == name || !hashPattern.MatchString(hash) {
+		return invalidRequest("include %q is not named <sha256>.%s", name, lang)
+	}
+	for _, object := range objectNames {
+		if !objectNamePattern.MatchString(object) {
+			return invalidRequest("include %s has invalid object name %q", name, object)
+		}
+	}
+	return nil
+}
+
+// Check a compile request can be served without touching files outside the
+// cache or poisoning it for other clients
+func validateRequest(req *definitions.Request) error {
+	if err := validateLanguage(req.Language); err != nil {
+		return err
+	}
+	for name, include := range req.Includes {
+		if include == nil {
+			return invalidRequest("include %s is empty", name)
+		}
+		if err := validateInclude(req.Language, name, include.ObjectNames); err != nil {
+			return err
+		}
+		// scripts left out are loaded from those the server stored
+		if len(include.Script) > 0 && !scriptMatches(req.Language, name, include.Script) {
+			return invalidRequest("script of include %s does not match its hash", name)
+		}
+	}
+	return nil
+}
+
+// Check a negotiation request names only includes validateRequest accepts
+func validateNegotiation(req *definitions.NegotiationRequest) error {
+	if err := validateLanguage(req.Language); err != nil {
+		return err
+	}
+	for name, objectNames := range req.Includes {
+		if err := validateInclude(req.Language, name, objectNames); err != nil {
+			return err
+		}
+	}
+	return nil
+}
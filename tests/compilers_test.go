@@ -41,10 +41,10 @@ contract c {
 		t.Fatal(err)
 	}
 	if req.Libraries != "" {
-		t.Errorf("Expected empty libraries, got ", req.Libraries)
+		t.Errorf("Expected empty libraries, got %s", req.Libraries)
 	}
 	if req.Language != "sol" {
-		t.Errorf("Expected Solidity file, got ", req.Language)
+		t.Errorf("Expected Solidity file, got %s", req.Language)
 	}
 	if req.Optimize != false {
 		t.Errorf("Expected false optimize, got true")
@@ -69,6 +69,7 @@ func TestServerSingle(t *testing.T) {
 	err = json.Unmarshal([]byte(output), expectedSolcResponse)
 
 	respItemArray := make([]perform.ResponseItem, 0)
+	rebuilt := make([]string, 0)
 
 	for contract, item := range expectedSolcResponse.Contracts {
 		respItem := perform.ResponseItem{
@@ -77,12 +78,14 @@ func TestServerSingle(t *testing.T) {
 			ABI:        strings.TrimSpace(item.Abi),
 		}
 		respItemArray = append(respItemArray, respItem)
+		rebuilt = append(rebuilt, respItem.Objectname)
 	}
 	expectedResponse := &perform.Response{
 		Objects: respItemArray,
 		Warning: "",
 		Version: "",
 		Error:   "",
+		Rebuilt: rebuilt,
 	}
 	util.ClearCache(config.SolcScratchPath)
 	t.Log(testServer.URL)
@@ -200,6 +203,7 @@ func TestLocalSingle(t *testing.T) {
 	err = json.Unmarshal([]byte(output), expectedSolcResponse)
 
 	respItemArray := make([]perform.ResponseItem, 0)
+	rebuilt := make([]string, 0)
 
 	for contract, item := range expectedSolcResponse.Contracts {
 		respItem := perform.ResponseItem{
@@ -208,12 +212,14 @@ func TestLocalSingle(t *testing.T) {
 			ABI:        strings.TrimSpace(item.Abi),
 		}
 		respItemArray = append(respItemArray, respItem)
+		rebuilt = append(rebuilt, respItem.Objectname)
 	}
 	expectedResponse := &perform.Response{
 		Objects: respItemArray,
 		Warning: "",
 		Version: "",
 		Error:   "",
+		Rebuilt: rebuilt,
 	}
 	util.ClearCache(config.SolcScratchPath)
 	resp, err := perform.RequestCompile("", "simpleContract.sol", false, "")
@@ -231,7 +237,7 @@ func TestFaultyContract(t *testing.T) {
 	var expectedSolcResponse perform.Response
 
 	actualOutput, err := exec.Command("solc", "--combined-json", "bin,abi", "faultyContract.sol").CombinedOutput()
-	err = json.Unmarshal(actualOutput, expectedSolcResponse)
+	err = json.Unmarshal(actualOutput, &expectedSolcResponse)
 	t.Log(expectedSolcResponse.Error)
 	resp, err := perform.RequestCompile("", "faultyContract.sol", false, "")
 	t.Log(resp.Error)
@@ -241,7 +247,7 @@ func TestFaultyContract(t *testing.T) {
 		}
 	}
 	output := strings.TrimSpace(string(actualOutput))
-	err = json.Unmarshal([]byte(output), expectedSolcResponse)
+	err = json.Unmarshal([]byte(output), &expectedSolcResponse)
 }
 
 func TestBinaryLinkage(t *testing.T) {